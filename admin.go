@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/jackc/pgx/v5"
+)
+
+// Количество подписок в одной странице списка
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// SubscriberQuery - Условия выборки подписок. Пустые поля не ограничивают выборку
+type SubscriberQuery struct {
+	Hook   string   // Имя хука или шаблон, на который сделана подписка
+	Labels []string // Подписки, у которых есть все эти метки
+	Limit  int      // По умолчанию 100, максимум 1000
+	Offset int
+}
+
+// SubscriberInfo - Подписка в списке для администраторов. Секреты подписки (pass_code, авторизация, TLS, заголовки)
+// в список не попадают
+type SubscriberInfo struct {
+	ID           int64                  `json:"id"`
+	Hook         string                 `json:"hook"`
+	URL          string                 `json:"url"`
+	ErrCount     int                    `json:"err_count"`
+	EventTypes   []string               `json:"event_types"`
+	Filter       string                 `json:"filter"`
+	Description  string                 `json:"description"`
+	ContactEmail string                 `json:"contact_email"`
+	Labels       []string               `json:"labels"`
+	Metadata     map[string]interface{} `json:"metadata"`
+	CreatedAt    time.Time              `json:"created_at"`
+	ExpiresAt    *time.Time             `json:"expires_at"` // nil - бессрочная подписка
+}
+
+type listSubscribersResponse struct {
+	Success     bool             `json:"success"`
+	Subscribers []SubscriberInfo `json:"subscribers"`
+}
+
+// ListSubscribers - Список подписок, отсортированный по ID
+func (s *Service) ListSubscribers(ctx context.Context, q SubscriberQuery) (list []SubscriberInfo, err error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultListLimit
+	}
+	if q.Limit > maxListLimit || q.Offset < 0 {
+		return nil, fmt.Errorf("incorrect parameters limit='%d', offset='%d'", q.Limit, q.Offset)
+	}
+
+	labels := q.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+
+	var rows pgx.Rows
+	if rows, err = s.pg.Query(ctx, s.query(sqlListSubs), q.Hook, labels, q.Limit, q.Offset); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list = []SubscriberInfo{}
+	for rows.Next() {
+		var i SubscriberInfo
+		if err = rows.Scan(&i.ID, &i.Hook, &i.URL, &i.ErrCount, &i.EventTypes, &i.Filter, &i.Description,
+			&i.ContactEmail, &i.Labels, &i.Metadata, &i.CreatedAt, &i.ExpiresAt); err != nil {
+			return nil, err
+		}
+		// URL брокеров, сохраненные до шифрования, могут содержать учетные данные
+		i.URL = redactURL(i.URL)
+		list = append(list, i)
+	}
+	return list, rows.Err()
+}
+
+// listSubscribersHandler - Список подписок: GET /hook/admin/subs?hook=&label=&limit=&offset=.
+// Доступен только с Config.AdminTokens
+func (h *hookCtx) listSubscribersHandler(w web.ResponseWriter, r *web.Request) {
+	if !authorizeBearer(r.Request, h.s.cfg.AdminTokens) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="hook"`)
+		sendHookResponse(w, "", newHTTPError(http.StatusUnauthorized, "invalid admin token"))
+		return
+	}
+
+	query := r.URL.Query()
+	q := SubscriberQuery{Hook: query.Get("hook"), Labels: formList(query["label"])}
+
+	var err error
+	if v := query.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter limit"))
+			return
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if q.Offset, err = strconv.Atoi(v); err != nil {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter offset"))
+			return
+		}
+	}
+
+	if q.Limit < 0 || q.Limit > maxListLimit || q.Offset < 0 {
+		sendHookResponse(w, "", fmt.Errorf("incorrect parameters limit='%d', offset='%d'", q.Limit, q.Offset))
+		return
+	}
+
+	var list []SubscriberInfo
+	if list, err = h.s.ListSubscribers(r.Context(), q); err != nil {
+		sendHookResponse(w, "", newHTTPError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	if !sendJSON(w, http.StatusOK, listSubscribersResponse{Success: true, Subscribers: list}) {
+		log.Printf(serviceErr, h.s.name, "cannot send subscribers list")
+	}
+}
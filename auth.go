@@ -0,0 +1,328 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	u "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Схемы авторизации исходящих запросов к подписчику
+const (
+	AuthBasic  = "basic"  // Basic-авторизация по Username/Password
+	AuthBearer = "bearer" // Статический токен Token в заголовке Authorization
+	AuthOAuth2 = "oauth2" // OAuth2 client credentials: токен запрашивается у TokenURL и кешируется до истечения
+)
+
+// Запас времени, за который токен OAuth2 считается истекшим и запрашивается заново
+const oauth2ExpiryDelta = 30 * time.Second
+
+// Ограничение на размер ответа сервера авторизации
+const maxTokenResponseBytes = 1 << 20
+
+// Заголовки, которые формирует сам сервис и которые нельзя переопределить в подписке
+var reservedHeaders = map[string]bool{
+	"Authorization":      true,
+	"Content-Type":       true,
+	"Content-Length":     true,
+	"Host":               true,
+	"Transfer-Encoding":  true,
+	"Connection":         true,
+	HeaderEventID:        true,
+	HeaderEventType:      true,
+	HeaderHookName:       true,
+	HeaderAttempt:        true,
+	HeaderTimestamp:      true,
+	HeaderIdempotencyKey: true,
+	HeaderSignature:      true,
+	HeaderSequence:       true,
+	HeaderBatchID:        true,
+	HeaderBatchSize:      true,
+}
+
+// SubscriberAuth - Авторизация, которую сервис применяет к каждой отправке подписчику.
+// Хранится в БД в зашифрованном виде (см. Config.SecretKey)
+type SubscriberAuth struct {
+	Type string `json:"type"`
+
+	Username string `json:"username,omitempty"` // basic
+	Password string `json:"password,omitempty"` // basic
+
+	Token string `json:"token,omitempty"` // bearer
+
+	TokenURL     string   `json:"token_url,omitempty"`     // oauth2
+	ClientID     string   `json:"client_id,omitempty"`     // oauth2
+	ClientSecret string   `json:"client_secret,omitempty"` // oauth2
+	Scopes       []string `json:"scopes,omitempty"`        // oauth2
+}
+
+func (a *SubscriberAuth) validate() error {
+	switch a.Type {
+	case AuthBasic:
+		if a.Username == "" {
+			return fmt.Errorf("basic auth requires username")
+		}
+	case AuthBearer:
+		if a.Token == "" {
+			return fmt.Errorf("bearer auth requires token")
+		}
+	case AuthOAuth2:
+		if a.ClientID == "" || a.ClientSecret == "" {
+			return fmt.Errorf("oauth2 auth requires client_id and client_secret")
+		}
+		if tokenURL, err := u.Parse(a.TokenURL); err != nil || (tokenURL.Scheme != "http" && tokenURL.Scheme != "https") {
+			return fmt.Errorf("oauth2 auth requires valid http(s) token_url")
+		}
+	default:
+		return fmt.Errorf("unknown auth type '%s'", a.Type)
+	}
+	return nil
+}
+
+func validateHeaders(headers map[string]string) error {
+	for k, v := range headers {
+		if !validHeaderName(k) {
+			return fmt.Errorf("invalid header name '%s'", k)
+		}
+		if reservedHeaders[http.CanonicalHeaderKey(k)] {
+			return fmt.Errorf("header '%s' cannot be overridden", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid value of header '%s'", k)
+		}
+	}
+	return nil
+}
+
+// decryptAuth - Чтение авторизации подписчика из зашифрованного значения в БД
+func (s *Service) decryptAuth(secret []byte) (auth *SubscriberAuth, err error) {
+	if len(secret) == 0 {
+		return nil, nil
+	}
+
+	var plain []byte
+	if plain, err = s.decryptSecret(secret); err != nil {
+		return nil, err
+	}
+
+	auth = &SubscriberAuth{}
+	if err = json.Unmarshal(plain, auth); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// decryptTLS - Чтение настроек TLS подписчика из зашифрованного значения в БД
+func (s *Service) decryptTLS(secret []byte) (cfg *TLSConfig, err error) {
+	if len(secret) == 0 {
+		return nil, nil
+	}
+
+	var plain []byte
+	if plain, err = s.decryptSecret(secret); err != nil {
+		return nil, err
+	}
+
+	cfg = &TLSConfig{}
+	if err = json.Unmarshal(plain, cfg); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// decryptHeaders - Чтение дополнительных заголовков подписчика из зашифрованного значения в БД
+func (s *Service) decryptHeaders(secret []byte) (headers map[string]string, err error) {
+	var plain []byte
+	if plain, err = s.decryptSecret(secret); err != nil {
+		return nil, err
+	}
+
+	headers = map[string]string{}
+	if err = json.Unmarshal(plain, &headers); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// encryptPlainHeaders - Шифрование заголовков подписок, сохраненных открыто до появления headers_secret.
+// Без Config.SecretKey заголовки остаются как есть
+func (s *Service) encryptPlainHeaders(ctx context.Context) (err error) {
+	if len(s.cfg.SecretKey) == 0 {
+		return
+	}
+
+	var rows pgx.Rows
+	if rows, err = s.pg.Query(ctx, s.query(sqlSelectPlainHeaders)); err != nil {
+		return
+	}
+
+	secrets := map[int64][]byte{}
+	for rows.Next() {
+		var id int64
+		var headers []byte
+		if err = rows.Scan(&id, &headers); err != nil {
+			rows.Close()
+			return
+		}
+		if secrets[id], err = s.encryptSecret(headers); err != nil {
+			rows.Close()
+			return
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for id, secret := range secrets {
+		if _, err = s.pg.Exec(ctx, s.query(sqlSetHeadersSecret), id, secret); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// applyAuth - Установка заголовков подписки и авторизации в исходящий запрос
+func (s *Subscriber) applyAuth(req *http.Request) (err error) {
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if s.Auth == nil {
+		return
+	}
+
+	switch s.Auth.Type {
+	case AuthBasic:
+		req.SetBasicAuth(s.Auth.Username, s.Auth.Password)
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+s.Auth.Token)
+	case AuthOAuth2:
+		var token string
+		if token, err = s.hook.service.tokens.get(req.Context(), s.hook.clientFor(s), s.Auth); err != nil {
+			return fmt.Errorf("cannot get oauth2 token from '%s': %v", s.Auth.TokenURL, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return
+}
+
+// tokenCache - Кеш токенов OAuth2 client credentials. Общий для всех хуков сервиса,
+// так что подписчики с одинаковыми учетными данными используют один токен
+type tokenCache struct {
+	tokens map[string]*cachedToken
+	sync.Mutex
+}
+
+type cachedToken struct {
+	value  string
+	expiry time.Time // Нулевое значение - токен бессрочный
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{tokens: map[string]*cachedToken{}}
+}
+
+func tokenCacheKey(a *SubscriberAuth) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{a.TokenURL, a.ClientID, a.ClientSecret, strings.Join(a.Scopes, " ")}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *tokenCache) get(ctx context.Context, client *http.Client, a *SubscriberAuth) (token string, err error) {
+	key := tokenCacheKey(a)
+
+	c.Lock()
+	t := c.tokens[key]
+	c.Unlock()
+	if t != nil && (t.expiry.IsZero() || time.Now().Add(oauth2ExpiryDelta).Before(t.expiry)) {
+		return t.value, nil
+	}
+
+	if t, err = fetchToken(ctx, client, a); err != nil {
+		return "", err
+	}
+
+	c.Lock()
+	c.evictExpired(time.Now())
+	c.tokens[key] = t
+	c.Unlock()
+	return t.value, nil
+}
+
+// evictExpired - Удаление истекших токенов, чтобы кеш не рос с каждой новой подпиской.
+// Вызывается под блокировкой кеша
+func (c *tokenCache) evictExpired(now time.Time) {
+	for key, t := range c.tokens {
+		if !t.expiry.IsZero() && now.After(t.expiry) {
+			delete(c.tokens, key)
+		}
+	}
+}
+
+// invalidate - Удаление токена из кеша, например если получатель ответил 401
+func (c *tokenCache) invalidate(a *SubscriberAuth) {
+	if a == nil || a.Type != AuthOAuth2 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	delete(c.tokens, tokenCacheKey(a))
+}
+
+func fetchToken(ctx context.Context, client *http.Client, a *SubscriberAuth) (t *cachedToken, err error) {
+	form := u.Values{"grant_type": {"client_credentials"}}
+	if len(a.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.Scopes, " "))
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, a.TokenURL, strings.NewReader(form.Encode())); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(u.QueryEscape(a.ClientID), u.QueryEscape(a.ClientSecret))
+
+	var resp *http.Response
+	if resp, err = client.Do(req); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body []byte
+	if body, err = io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseBytes)); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.Unmarshal(body, &tr); err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+
+	if tr.AccessToken == "" {
+		return nil, fmt.Errorf("token response without access_token")
+	}
+
+	t = &cachedToken{value: tr.AccessToken}
+	if tr.ExpiresIn > 0 {
+		t.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	return t, nil
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Форматы тела запроса с пачкой событий
+const (
+	BatchJSON      = "json"      // JSON массив событий (по умолчанию)
+	BatchMultipart = "multipart" // multipart/mixed, каждая часть - событие в том же виде, что и без пачек
+)
+
+// Значения по умолчанию для BatchOptions
+const (
+	defaultBatchMaxItems = 100
+	defaultBatchMaxWait  = time.Second
+)
+
+// Заголовки запроса с пачкой событий. X-Hook-Event-Id и X-Hook-Event в нем не передаются, они есть у каждого события
+const (
+	HeaderBatchID   = "X-Hook-Batch-Id"   // ID пачки, одинаковый для всех повторов. Также передается в Idempotency-Key
+	HeaderBatchSize = "X-Hook-Batch-Size" // Количество событий в пачке
+)
+
+// BatchOptions - Настройки отправки событий пачками. Событие отправляется подписчику, когда в его пачке
+// накопилось MaxItems событий или с момента первого события прошло MaxWait. Повторы (и перенос в dead letters
+// в режиме Ordered) применяются к пачке целиком
+type BatchOptions struct {
+	MaxItems int           // Максимальное количество событий в пачке. По умолчанию 100
+	MaxWait  time.Duration // Сколько ждать накопления пачки. По умолчанию 1 секунда
+	Format   string        // BatchJSON (по умолчанию) или BatchMultipart
+}
+
+func (o *BatchOptions) validate() error {
+	if o.MaxItems < 0 || o.MaxWait < 0 {
+		return fmt.Errorf("negative batch values are not allowed")
+	}
+
+	switch o.Format {
+	case "", BatchJSON, BatchMultipart:
+	default:
+		return fmt.Errorf("unsupported batch format '%s'", o.Format)
+	}
+	return nil
+}
+
+func (o *BatchOptions) maxItems() int {
+	if o.MaxItems == 0 {
+		return defaultBatchMaxItems
+	}
+	return o.MaxItems
+}
+
+func (o *BatchOptions) maxWait() time.Duration {
+	if o.MaxWait == 0 {
+		return defaultBatchMaxWait
+	}
+	return o.MaxWait
+}
+
+// body - Тело запроса с пачкой событий
+func (o *BatchOptions) body(events []*event) (buf *bytes.Buffer, contentType string, err error) {
+	buf = &bytes.Buffer{}
+
+	if o.Format != BatchMultipart {
+		items := make([]eventItem, len(events))
+		for i, e := range events {
+			items[i] = e.item()
+		}
+		if err = json.NewEncoder(buf).Encode(items); err != nil {
+			return nil, "", err
+		}
+		return buf, "application/json", nil
+	}
+
+	w := multipart.NewWriter(buf)
+	for _, e := range events {
+		var data io.Reader
+		var partType string
+		if data, partType, err = e.form.Data(); err != nil {
+			return nil, "", err
+		}
+
+		var part io.Writer
+		part, err = w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {partType},
+			HeaderEventID:   {e.id},
+			HeaderEventType: {e.eventType()},
+			HeaderTimestamp: {strconv.FormatInt(e.created.Unix(), 10)},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err = io.Copy(part, data); err != nil {
+			return nil, "", err
+		}
+	}
+	if err = w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf, "multipart/mixed; boundary=" + w.Boundary(), nil
+}
+
+// setBatchHeaders - Установка заголовков пачки
+func setBatchHeaders(h http.Header, task *sendTask) {
+	h.Set(HeaderBatchID, task.batchID)
+	h.Set(HeaderIdempotencyKey, task.batchID)
+	h.Set(HeaderBatchSize, strconv.Itoa(len(task.events)))
+	h.Set(HeaderHookName, task.sub.hook.name)
+	h.Set(HeaderAttempt, strconv.Itoa(task.attempt))
+	h.Set(HeaderTimestamp, strconv.FormatInt(task.events[0].created.Unix(), 10))
+}
+
+// pendingBatch - Копящаяся пачка событий одного подписчика
+type pendingBatch struct {
+	subID  int64
+	sub    *Subscriber // Данные подписки из последнего вызова хука
+	events []*event
+	timer  *time.Timer
+}
+
+// addToBatch - Добавление события в пачку подписчика. Заполненная пачка сразу ставится в очередь отправки
+func (h *hook) addToBatch(sub *Subscriber, ev *event) {
+	ev.tracker.acquire()
+
+	h.batchMu.Lock()
+	b := h.batches[sub.ID]
+	if b == nil {
+		b = &pendingBatch{subID: sub.ID}
+		h.batches[sub.ID] = b
+		b.timer = time.AfterFunc(h.opts.Batch.maxWait(), func() { h.flushBatch(b) })
+	}
+	b.sub = sub
+	b.events = append(b.events, ev)
+	full := len(b.events) >= h.opts.Batch.maxItems()
+	h.batchMu.Unlock()
+
+	if full {
+		h.flushBatch(b)
+	}
+}
+
+// takeBatch - Извлечение пачки из копящихся и остановка ее таймера. Возвращает false, если пачку уже забрали.
+// После извлечения в пачку больше ничего не добавляется, поэтому дальше она читается без блокировки
+func (h *hook) takeBatch(b *pendingBatch) bool {
+	h.batchMu.Lock()
+	defer h.batchMu.Unlock()
+	if h.batches[b.subID] != b {
+		return false
+	}
+	delete(h.batches, b.subID)
+	b.timer.Stop()
+	return true
+}
+
+// flushBatch - Постановка пачки в очередь отправки. batchMu не удерживается во время обращений к БД,
+// а batchSendMu сохраняет порядок: пачки получают порядковые номера в том же порядке, в котором извлекаются
+func (h *hook) flushBatch(b *pendingBatch) {
+	h.batchSendMu.Lock()
+	defer h.batchSendMu.Unlock()
+
+	if !h.takeBatch(b) {
+		return
+	}
+
+	ctx := h.service.ctx
+	task := h.batchTask(ctx, b)
+	if task == nil {
+		finishEvents(b.events, false)
+		return
+	}
+	if err := h.dispatch(ctx, []*sendTask{task}); err != nil {
+		log.Printf(hookErr, h.name, fmt.Sprintf("cannot send batch to url='%s': %v", task.sub.URL, err))
+		task.finish()
+	}
+}
+
+// batchTask - Отправка пачки с актуальными данными подписки. Пока пачка копилась, подписку могли удалить
+// или изменить (счетчик ошибок, секреты), поэтому она перечитывается из БД. Возвращает nil, если подписки больше нет
+func (h *hook) batchTask(ctx context.Context, b *pendingBatch) *sendTask {
+	sub, err := h.loadSub(ctx, b.subID)
+	if err != nil {
+		log.Printf(hookErr, h.name, fmt.Sprintf("cannot load subscription of batch url='%s': %v", b.sub.URL, err))
+		return nil
+	}
+	if sub == nil {
+		log.Printf(hookWarning, h.name, fmt.Sprintf("batch of %d events dropped, subscription url='%s' deleted", len(b.events), b.sub.URL))
+		return nil
+	}
+
+	task := newSendTask(sub, 1, b.events...)
+	task.batchID = uuid.New().String()
+	return task
+}
+
+// stopBatches - Отправка накопленных пачек при остановке сервиса одной попыткой без повторов.
+// В режиме Ordered пачки остаются недоставленными, как и события в очереди подписчика (laneStopped):
+// очередь при остановке не дослушивается, отправка в обход нее нарушила бы порядок, а остановка сервиса -
+// не ошибка доставки, поэтому и в dead letters они не переносятся
+func (h *hook) stopBatches(ctx context.Context) {
+	h.batchSendMu.Lock()
+	defer h.batchSendMu.Unlock()
+
+	h.batchMu.Lock()
+	pending := make([]*pendingBatch, 0, len(h.batches))
+	for id, b := range h.batches {
+		b.timer.Stop()
+		delete(h.batches, id)
+		pending = append(pending, b)
+	}
+	h.batchMu.Unlock()
+
+	for _, b := range pending {
+		if h.opts.Ordered {
+			log.Printf(hookWarning, h.name, fmt.Sprintf("batch of %d events to url='%s' not delivered on stop", len(b.events), b.sub.URL))
+			continue
+		}
+
+		task := h.batchTask(ctx, b)
+		if task == nil {
+			finishEvents(b.events, false)
+			continue
+		}
+
+		// Недоставленные события outbox остаются незавершенными и возвращаются в outbox при остановке
+		if outcome, _ := task.send(ctx); outcome != deliveryDelivered {
+			log.Printf(hookWarning, h.name, fmt.Sprintf("batch of %d events to url='%s' not delivered on stop: %s", len(task.events), task.sub.URL, task.lastErr))
+			continue
+		}
+		task.finish()
+	}
+}
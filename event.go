@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Заголовки, по которым подписчик может дедуплицировать и сопоставлять отправки
+const (
+	HeaderEventID        = "X-Hook-Event-Id"         // Уникальный идентификатор события (вызова хука)
+	HeaderEventType      = "X-Hook-Event"            // Тип события (Form.Event или имя хука)
+	HeaderHookName       = "X-Hook-Name"             // Имя хука
+	HeaderAttempt        = "X-Hook-Delivery-Attempt" // Номер попытки доставки события этому подписчику, начиная с 1
+	HeaderTimestamp      = "X-Hook-Timestamp"        // Время создания события, unix секунды
+	HeaderIdempotencyKey = "Idempotency-Key"         // Совпадает с X-Hook-Event-Id
+	HeaderSequence       = "X-Hook-Sequence"         // Порядковый номер события у подписчика, только для HookOptions.Ordered
+)
+
+// Сколько хранятся события и история их доставки, если не задано Config.EventRetention
+const defaultEventRetention = 7 * 24 * time.Hour
+
+// Имя внутреннего воркера, удаляющего устаревшие события
+const eventsCleanupWorker = "hook_events_cleanup"
+
+// event - Одно срабатывание хука. Все попытки доставки всем подписчикам имеют один и тот же ID
+type event struct {
+	id       string
+	hook     string
+	form     *Form
+	created  time.Time
+	personal bool             // Данные события сформированы для конкретного подписчика
+	tracker  *deliveryTracker // Ожидание завершения доставки (outbox, предупреждение об истечении), иначе nil
+}
+
+func newEvent(hookName string, form *Form) *event {
+	return &event{
+		id:      uuid.New().String(),
+		hook:    hookName,
+		form:    form,
+		created: time.Now(),
+	}
+}
+
+// personalize - Копия события с данными form для одного подписчика
+func (e *event) personalize(form *Form) *event {
+	return &event{id: e.id, hook: e.hook, form: form, created: e.created, personal: true, tracker: e.tracker}
+}
+
+func (e *event) eventType() string {
+	return e.form.eventType(e.hook)
+}
+
+// eventItem - JSON представление события в пачке и в потоке
+type eventItem struct {
+	ID        string            `json:"id"`
+	Hook      string            `json:"hook"`
+	Event     string            `json:"event"`
+	Timestamp int64             `json:"timestamp"`
+	Payload   map[string]string `json:"payload"`
+}
+
+func (e *event) item() eventItem {
+	return eventItem{ID: e.id, Hook: e.hook, Event: e.eventType(), Timestamp: e.created.Unix(), Payload: e.form.Payload}
+}
+
+// setHeaders - Установка заголовков события для попытки attempt
+func (e *event) setHeaders(h http.Header, attempt int) {
+	h.Set(HeaderEventID, e.id)
+	h.Set(HeaderIdempotencyKey, e.id)
+	h.Set(HeaderEventType, e.eventType())
+	h.Set(HeaderHookName, e.hook)
+	h.Set(HeaderAttempt, strconv.Itoa(attempt))
+	h.Set(HeaderTimestamp, strconv.FormatInt(e.created.Unix(), 10))
+}
+
+// saveEvent - Сохранение события в БД, чтобы по его ID можно было найти историю доставки
+func (s *Service) saveEvent(ctx context.Context, e *event) (err error) {
+	_, err = s.pg.Exec(ctx, s.query(sqlInsertEvent), e.id, e.hook, e.eventType(), e.form.Payload, e.created)
+	return
+}
+
+// recordDelivery - Запись результата попытки доставки для каждого события отправки. Ошибка записи только логируется,
+// т.к. не должна влиять на саму доставку
+func (s *Service) recordDelivery(ctx context.Context, task *sendTask, statusCode int, sendErr error, duration time.Duration) {
+	var status *int
+	if statusCode != 0 {
+		status = &statusCode
+	}
+
+	var errText string
+	if sendErr != nil {
+		errText = sendErr.Error()
+	}
+
+	for _, e := range task.events {
+		_, err := s.pg.Exec(ctx, s.query(sqlInsertDelivery),
+			e.id, task.sub.ID, task.sub.URL, task.attempt, status, errText, duration.Milliseconds())
+		if err != nil {
+			log.Printf(hookErr, task.sub.hook.name, fmt.Sprintf("cannot record delivery event_id='%s' url='%s': %v", e.id, task.sub.URL, err))
+		}
+	}
+}
+
+// saveDeadLetter - Запись событий, доставку которых подписчику прекратили. Ошибка записи только логируется
+func (s *Service) saveDeadLetter(ctx context.Context, task *sendTask) {
+	var seq *int64
+	if task.seq != 0 {
+		seq = &task.seq
+	}
+
+	for _, e := range task.events {
+		_, err := s.pg.Exec(ctx, s.query(sqlInsertDeadLetter),
+			e.id, task.sub.ID, task.sub.hook.name, task.sub.URL, seq, task.attempt, task.lastErr)
+		if err != nil {
+			log.Printf(hookErr, task.sub.hook.name, fmt.Sprintf("cannot save dead letter event_id='%s' url='%s': %v", e.id, task.sub.URL, err))
+			continue
+		}
+		log.Printf(hookWarning, task.sub.hook.name, fmt.Sprintf("event_id='%s' moved to dead letters for url='%s' after %d attempts", e.id, task.sub.URL, task.attempt))
+	}
+}
+
+// nextSeq - Следующий порядковый номер события у подписчика
+func (s *Service) nextSeq(ctx context.Context, subID int64) (seq int64, err error) {
+	err = s.pg.QueryRow(ctx, s.query(sqlNextSubSeq), subID).Scan(&seq)
+	return
+}
+
+// cleanupEvents - Удаление событий и истории доставки старше Config.EventRetention
+func (s *Service) cleanupEvents() (err error) {
+	if s.pg == nil {
+		return
+	}
+
+	retention := s.cfg.EventRetention
+	if retention == 0 {
+		retention = defaultEventRetention
+	}
+
+	_, err = s.pg.Exec(s.ctx, s.query(sqlDeleteOldEvents), time.Now().Add(-retention))
+	return
+}
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Фильтр подписки - простое выражение над полями Form.Payload, например:
+//
+//	status in (paid, refunded) and amount != 0
+//	not (source = test) or force = "yes"
+//
+// Поддерживаются операторы =, !=, in, not in, логические and, or, not и скобки.
+// Значения пишутся как есть или в одинарных/двойных кавычках. Отсутствующее поле считается пустой строкой
+
+const maxFilterLen = 1024
+
+// Разобранных фильтров в кеше. При переполнении кеш очищается целиком
+const maxFilterCache = 4096
+
+// filterCache - Разобранные фильтры по тексту выражения, чтобы не разбирать фильтр подписки при каждом вызове хука.
+// Выражения неизменяемы, поэтому одно значение используется всеми подписками с одинаковым фильтром
+var filterCache = struct {
+	sync.Mutex
+	exprs map[string]filterExpr
+}{exprs: map[string]filterExpr{}}
+
+// cachedFilter - parseFilter с кешем. Ошибки не кешируются: они означают, что строку изменили в обход сервиса
+func cachedFilter(src string) (expr filterExpr, err error) {
+	filterCache.Lock()
+	expr, ok := filterCache.exprs[src]
+	filterCache.Unlock()
+	if ok {
+		return
+	}
+
+	if expr, err = parseFilter(src); err != nil {
+		return
+	}
+
+	filterCache.Lock()
+	if len(filterCache.exprs) >= maxFilterCache {
+		filterCache.exprs = map[string]filterExpr{}
+	}
+	filterCache.exprs[src] = expr
+	filterCache.Unlock()
+	return
+}
+
+// filterExpr - узел разобранного выражения фильтра
+type filterExpr interface {
+	match(attr func(key string) string) bool
+}
+
+type filterAnd struct{ left, right filterExpr }
+type filterOr struct{ left, right filterExpr }
+type filterNot struct{ expr filterExpr }
+
+// filterCond - сравнение поля со списком значений. Для = и != список состоит из одного значения
+type filterCond struct {
+	key    string
+	values []string
+	negate bool
+}
+
+func (f filterAnd) match(attr func(string) string) bool {
+	return f.left.match(attr) && f.right.match(attr)
+}
+func (f filterOr) match(attr func(string) string) bool {
+	return f.left.match(attr) || f.right.match(attr)
+}
+func (f filterNot) match(attr func(string) string) bool { return !f.expr.match(attr) }
+
+func (f filterCond) match(attr func(string) string) bool {
+	v := attr(f.key)
+	for i := range f.values {
+		if f.values[i] == v {
+			return !f.negate
+		}
+	}
+	return f.negate
+}
+
+// parseFilter - Разбор выражения фильтра. Для пустой строки возвращает nil, что означает "пропускать все"
+func parseFilter(src string) (expr filterExpr, err error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, nil
+	}
+
+	if len(src) > maxFilterLen {
+		return nil, fmt.Errorf("filter: expression is longer than %d bytes", maxFilterLen)
+	}
+
+	p := &filterParser{}
+	if p.tokens, err = tokenizeFilter(src); err != nil {
+		return nil, err
+	}
+
+	if expr, err = p.parseOr(); err != nil {
+		return nil, err
+	}
+
+	if !p.eof() {
+		return nil, fmt.Errorf("filter: unexpected '%s'", p.peek().text)
+	}
+	return
+}
+
+type filterToken struct {
+	text   string
+	quoted bool // Значение в кавычках никогда не считается ключевым словом или оператором
+}
+
+func tokenizeFilter(src string) (tokens []filterToken, err error) {
+	r := []rune(src)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')' || c == ',' || c == '=':
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		case c == '!':
+			if i+1 >= len(r) || r[i+1] != '=' {
+				return nil, fmt.Errorf("filter: unexpected '!' at position %d", i)
+			}
+			tokens = append(tokens, filterToken{text: "!="})
+			i += 2
+		case c == '\'' || c == '"':
+			j := i + 1
+			for j < len(r) && r[j] != c {
+				j++
+			}
+			if j >= len(r) {
+				return nil, fmt.Errorf("filter: unterminated string at position %d", i)
+			}
+			tokens = append(tokens, filterToken{text: string(r[i+1 : j]), quoted: true})
+			i = j + 1
+		case isFilterWordRune(c):
+			j := i
+			for j < len(r) && isFilterWordRune(r[j]) {
+				j++
+			}
+			tokens = append(tokens, filterToken{text: string(r[i:j])})
+			i = j
+		default:
+			return nil, fmt.Errorf("filter: unexpected '%c' at position %d", c, i)
+		}
+	}
+	return
+}
+
+func isFilterWordRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("_.-:+@/", c)
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) eof() bool { return p.pos >= len(p.tokens) }
+
+func (p *filterParser) peek() filterToken {
+	if p.eof() {
+		return filterToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+// keyword - Если следующий токен - ключевое слово или оператор kw, то пропускает его
+func (p *filterParser) keyword(kw string) bool {
+	t := p.peek()
+	if p.eof() || t.quoted || !strings.EqualFold(t.text, kw) {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *filterParser) expect(kw string) error {
+	if !p.keyword(kw) {
+		if p.eof() {
+			return fmt.Errorf("filter: expected '%s', got end of expression", kw)
+		}
+		return fmt.Errorf("filter: expected '%s', got '%s'", kw, p.peek().text)
+	}
+	return nil
+}
+
+func (p *filterParser) value() (string, error) {
+	t := p.peek()
+	if p.eof() || (!t.quoted && strings.ContainsAny(t.text, "(),=!")) {
+		return "", fmt.Errorf("filter: expected value, got '%s'", t.text)
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func (p *filterParser) parseOr() (expr filterExpr, err error) {
+	if expr, err = p.parseAnd(); err != nil {
+		return
+	}
+	for p.keyword("or") {
+		var right filterExpr
+		if right, err = p.parseAnd(); err != nil {
+			return
+		}
+		expr = filterOr{expr, right}
+	}
+	return
+}
+
+func (p *filterParser) parseAnd() (expr filterExpr, err error) {
+	if expr, err = p.parseUnary(); err != nil {
+		return
+	}
+	for p.keyword("and") {
+		var right filterExpr
+		if right, err = p.parseUnary(); err != nil {
+			return
+		}
+		expr = filterAnd{expr, right}
+	}
+	return
+}
+
+func (p *filterParser) parseUnary() (expr filterExpr, err error) {
+	if p.keyword("not") {
+		if expr, err = p.parseUnary(); err != nil {
+			return
+		}
+		return filterNot{expr}, nil
+	}
+
+	if p.keyword("(") {
+		if expr, err = p.parseOr(); err != nil {
+			return
+		}
+		return expr, p.expect(")")
+	}
+
+	return p.parseCond()
+}
+
+func (p *filterParser) parseCond() (expr filterExpr, err error) {
+	cond := filterCond{}
+	if cond.key, err = p.value(); err != nil {
+		return
+	}
+
+	switch {
+	case p.keyword("="):
+	case p.keyword("!="):
+		cond.negate = true
+	case p.keyword("in"):
+		return p.parseList(cond)
+	case p.keyword("not"):
+		if err = p.expect("in"); err != nil {
+			return
+		}
+		cond.negate = true
+		return p.parseList(cond)
+	default:
+		return nil, fmt.Errorf("filter: expected operator after '%s'", cond.key)
+	}
+
+	var v string
+	if v, err = p.value(); err != nil {
+		return
+	}
+	cond.values = []string{v}
+	return cond, nil
+}
+
+func (p *filterParser) parseList(cond filterCond) (expr filterExpr, err error) {
+	if err = p.expect("("); err != nil {
+		return
+	}
+
+	for {
+		var v string
+		if v, err = p.value(); err != nil {
+			return
+		}
+		cond.values = append(cond.values, v)
+
+		if p.keyword(")") {
+			return cond, nil
+		}
+		if err = p.expect(","); err != nil {
+			return
+		}
+	}
+}
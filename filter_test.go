@@ -0,0 +1,126 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFilterMatch(t *testing.T) {
+	payload := map[string]string{
+		"status": "paid",
+		"amount": "10",
+		"source": "test",
+		"force":  "yes",
+		"note":   "and",
+	}
+	attr := func(key string) string { return payload[key] }
+
+	tests := []struct {
+		name   string
+		filter string
+		want   bool
+	}{
+		{"empty", "", true},
+		{"spaces only", "   ", true},
+		{"eq", "status = paid", true},
+		{"eq mismatch", "status = new", false},
+		{"neq", "status != new", true},
+		{"in", "status in (new, paid)", true},
+		{"in mismatch", "status in (new, refunded)", false},
+		{"not in", "status not in (new, refunded)", true},
+		{"missing field is empty", `missing = ""`, true},
+		{"missing field neq", "missing != x", true},
+		{"keywords ignore case", "status = paid AND amount = 10", true},
+
+		// and связывает сильнее or: false or (true and true)
+		{"and before or", "status = new or amount = 10 and source = test", true},
+		// (false or true) and false
+		{"parens override", "(status = new or amount = 10) and source = prod", false},
+		// false or (true and false)
+		{"and before or mismatch", "status = new or amount = 10 and source = prod", false},
+		// not связывает сильнее and: (not false) and true
+		{"not before and", "not status = new and amount = 10", true},
+		// not (true and false)
+		{"not parens", "not (status = paid and source = prod)", true},
+		{"double not", "not not status = paid", true},
+		{"nested parens", "((status = paid))", true},
+
+		{"double quoted", `status = "paid"`, true},
+		{"single quoted", `status = 'paid'`, true},
+		{"quoted keyword value", `note = "and"`, true},
+		{"quoted key", `"status" = paid`, true},
+		{"quoted in list", `note in ('or', "and")`, true},
+		{"quoted with spaces", `status = "paid "`, false},
+		{"word runes", "email = a.b-c_d:e+f@g/h", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := parseFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("parseFilter(%q) error: %v", tt.filter, err)
+			}
+
+			got := expr == nil || expr.match(attr)
+			if got != tt.want {
+				t.Errorf("parseFilter(%q).match() = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		errMsg string
+	}{
+		{"unterminated double", `status = "paid`, "unterminated string"},
+		{"unterminated single", `status = 'paid`, "unterminated string"},
+		{"bare bang", "status ! paid", "unexpected '!'"},
+		{"unknown char", "status = paid;", "unexpected ';'"},
+		{"no operator", "status paid", "expected operator"},
+		{"no value", "status =", "expected value"},
+		{"operator as value", "status = =", "expected value"},
+		{"empty list", "status in ()", "expected value"},
+		{"list without parens", "status in paid", "expected '('"},
+		{"unclosed list", "status in (paid", "expected ','"},
+		{"trailing comma", "status in (paid,)", "expected value"},
+		{"not without in", "status not paid", "expected 'in'"},
+		{"unclosed paren", "(status = paid", "expected ')'"},
+		{"extra paren", "status = paid)", "unexpected ')'"},
+		{"dangling and", "status = paid and", "expected value"},
+		{"dangling not", "not", "expected value"},
+		{"too long", "status = " + strings.Repeat("a", maxFilterLen), "longer than"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseFilter(tt.filter)
+			if err == nil {
+				t.Fatalf("parseFilter(%q) error = nil, want %q", tt.filter, tt.errMsg)
+			}
+			if !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("parseFilter(%q) error = %q, want %q", tt.filter, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestCachedFilter(t *testing.T) {
+	first, err := cachedFilter("status = paid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cachedFilter("status = paid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.(filterCond).key != second.(filterCond).key {
+		t.Errorf("cachedFilter returned different expressions for the same filter")
+	}
+
+	if _, err = cachedFilter("status ="); err == nil {
+		t.Errorf("cachedFilter error = nil for invalid filter")
+	}
+}
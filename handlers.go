@@ -2,9 +2,13 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gocraft/web"
 )
@@ -20,13 +24,33 @@ type hookResponse struct {
 	Success bool   `json:"success"`
 	Error   string `json:"error,omitempty"`
 	Code    string `json:"code,omitempty"`
+	URL     string `json:"url,omitempty"` // Адрес созданной pull подписки
+
+	ExpiresAt     string `json:"expires_at,omitempty"`     // Время истечения подписки, RFC 3339
+	SigningSecret string `json:"signing_secret,omitempty"` // Секрет подписи отправок, если подписка создана с sign=true
+}
+
+// httpError - Ошибка с кодом ответа, отличным от 400
+type httpError struct {
+	status int
+	msg    string
 }
 
+func newHTTPError(status int, msg string) *httpError {
+	return &httpError{status: status, msg: msg}
+}
+
+func (e *httpError) Error() string { return e.msg }
+
 func sendHookResponse(w web.ResponseWriter, code string, err error) (success bool) {
 	var status int
 	var resp hookResponse
 	if err != nil {
 		status = http.StatusBadRequest
+		var hErr *httpError
+		if errors.As(err, &hErr) {
+			status = hErr.status
+		}
 		resp.Error = err.Error()
 	} else {
 		status = http.StatusOK
@@ -34,25 +58,26 @@ func sendHookResponse(w web.ResponseWriter, code string, err error) (success boo
 		resp.Success = true
 	}
 
-	var jsonData []byte
-	jsonData, err = json.Marshal(resp)
+	return sendJSON(w, status, resp) && status == http.StatusOK
+}
+
+// sendJSON - Отправка ответа в виде JSON. Возвращает false, если ответ отправить не удалось
+func sendJSON(w web.ResponseWriter, status int, resp interface{}) bool {
+	jsonData, err := json.Marshal(resp)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Printf("subscription: error='%v'", err)
 		return false
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	_, err = w.Write(jsonData)
 	if err != nil {
 		log.Printf("subscription: error='%v'", err)
 		return false
 	}
-
-	if status == 200 {
-		return true
-	}
-	return
+	return true
 }
 
 func (h *hookCtx) subscribeHandler(w web.ResponseWriter, r *web.Request) {
@@ -65,12 +90,132 @@ func (h *hookCtx) subscribeHandler(w web.ResponseWriter, r *web.Request) {
 
 	name := r.PathParams["name"]
 	url := r.PostFormValue("url")
+	opts := &SubscribeOptions{
+		EventTypes:   formList(r.PostForm["event_types"]),
+		Filter:       r.PostFormValue("filter"),
+		Description:  r.PostFormValue("description"),
+		ContactEmail: r.PostFormValue("contact_email"),
+		Labels:       formList(r.PostForm["labels"]),
+	}
+
+	if metadata := r.PostFormValue("metadata"); metadata != "" {
+		if err = json.Unmarshal([]byte(metadata), &opts.Metadata); err != nil {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter metadata, JSON object expected: %v", err))
+			return
+		}
+	}
+
+	if headers := r.PostFormValue("headers"); headers != "" {
+		if err = json.Unmarshal([]byte(headers), &opts.Headers); err != nil {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter headers, JSON object expected: %v", err))
+			return
+		}
+	}
+
+	if authType := r.PostFormValue("auth_type"); authType != "" {
+		opts.Auth = &SubscriberAuth{
+			Type:         authType,
+			Username:     r.PostFormValue("auth_username"),
+			Password:     r.PostFormValue("auth_password"),
+			Token:        r.PostFormValue("auth_token"),
+			TokenURL:     r.PostFormValue("auth_token_url"),
+			ClientID:     r.PostFormValue("auth_client_id"),
+			ClientSecret: r.PostFormValue("auth_client_secret"),
+			Scopes:       formList(r.PostForm["auth_scopes"]),
+		}
+	}
+
+	if opts.Auth != nil && opts.Auth.Type == AuthOAuth2 && !h.s.cfg.AllowOAuth2Subscriptions {
+		sendHookResponse(w, "", newHTTPError(http.StatusForbidden, "oauth2 subscriptions are not allowed"))
+		return
+	}
+
+	if tlsCert, tlsCA := r.PostFormValue("tls_cert"), r.PostFormValue("tls_ca"); tlsCert != "" || tlsCA != "" ||
+		r.PostFormValue("tls_server_name") != "" || r.PostFormValue("tls_min_version") != "" {
+		opts.TLS = &TLSConfig{
+			CertPEM:    tlsCert,
+			KeyPEM:     r.PostFormValue("tls_key"),
+			CAPEM:      tlsCA,
+			ServerName: r.PostFormValue("tls_server_name"),
+		}
+		if opts.TLS.MinVersion, err = parseTLSVersion(r.PostFormValue("tls_min_version")); err != nil {
+			sendHookResponse(w, "", err)
+			return
+		}
+	}
+
+	if rateLimit := r.PostFormValue("rate_limit"); rateLimit != "" {
+		if opts.RateLimit, err = strconv.ParseFloat(rateLimit, 64); err != nil {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter rate_limit"))
+			return
+		}
+	}
+
+	if lease := r.PostFormValue("lease_seconds"); lease != "" {
+		var seconds int
+		if seconds, err = strconv.Atoi(lease); err != nil || seconds < 0 {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter lease_seconds"))
+			return
+		}
+		opts.Lease = time.Duration(seconds) * time.Second
+	}
+
+	if rateBurst := r.PostFormValue("rate_burst"); rateBurst != "" {
+		if opts.RateBurst, err = strconv.Atoi(rateBurst); err != nil {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter rate_burst"))
+			return
+		}
+	}
+
+	// Секрет подписи генерирует сервис и возвращает его в ответе вместе с pass_code
+	if sign := r.PostFormValue("sign"); sign == "true" || sign == "1" {
+		if opts.SigningSecret, err = NewSigningSecret(); err != nil {
+			sendHookResponse(w, "", err)
+			return
+		}
+	}
 
 	var code string
-	code, err = h.s.SubscribeHook(name, url)
+	// Без url создается pull подписка, ее адрес возвращается клиенту
+	if url == "" {
+		if url, code, err = h.s.SubscribeHookPull(r.Context(), name, opts); err != nil {
+			sendHookResponse(w, "", err)
+			return
+		}
+		if sendJSON(w, http.StatusOK, hookResponse{Success: true, Code: code, URL: url}) {
+			log.Printf("hook: subscription success args:(hook='%s', url='%s')", name, redactURL(url))
+		}
+		return
+	}
+
+	// Брокеры обычно находятся во внутренней сети, поэтому извне на них подписаться можно только с разрешения
+	if isSinkURL(url) && !h.s.cfg.AllowSinkSubscriptions {
+		sendHookResponse(w, "", newHTTPError(http.StatusForbidden, "broker subscriptions are not allowed"))
+		return
+	}
+
+	code, err = h.s.SubscribeHook(r.Context(), name, url, opts)
+	if err == nil && opts.SigningSecret != "" {
+		if sendJSON(w, http.StatusOK, hookResponse{Success: true, Code: code, SigningSecret: opts.SigningSecret}) {
+			log.Printf("hook: subscription success args:(hook='%s', url='%s')", name, redactURL(url))
+		}
+		return
+	}
 	if sendHookResponse(w, code, err) {
-		log.Printf("hook: subscription success args:(hook='%s', url='%s', code='%s')", name, url, code)
+		log.Printf("hook: subscription success args:(hook='%s', url='%s')", name, redactURL(url))
+	}
+}
+
+// formList - Значения поля формы, переданные несколькими полями или одной строкой через запятую
+func formList(values []string) (list []string) {
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
 	}
+	return
 }
 
 func (h *hookCtx) unsubscribeHandler(w web.ResponseWriter, r *web.Request) {
@@ -85,8 +230,26 @@ func (h *hookCtx) unsubscribeHandler(w web.ResponseWriter, r *web.Request) {
 	url := r.PostFormValue("url")
 	passCode := r.PostFormValue("pass_code")
 
-	err = h.s.UnsubscribeHook(name, url, passCode)
+	keys, locked := h.passCodeLocked(w, r)
+	if locked {
+		return
+	}
+
+	err = h.s.UnsubscribeHook(r.Context(), name, url, passCode)
+	h.s.inbound.passCodeChecked(keys, err)
+
 	if sendHookResponse(w, "", err) {
-		log.Printf("hook: unsubscription success args:(hook='%s', url='%s', passCode='%s')", name, url, passCode)
+		log.Printf("hook: unsubscription success args:(hook='%s', url='%s')", name, redactURL(url))
+	}
+}
+
+// passCodeLocked - Проверка блокировки подбора pass_code (Config.Inbound). Если проверка pass_code заблокирована,
+// то отправляет ответ 429
+func (h *hookCtx) passCodeLocked(w web.ResponseWriter, r *web.Request) (keys []string, locked bool) {
+	keys, wait := h.s.inbound.passCodeLock(r.Request)
+	if wait > 0 {
+		sendTooManyRequests(w, wait, "too many invalid pass_code attempts")
+		return nil, true
 	}
+	return keys, false
 }
@@ -2,49 +2,72 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"mime/multipart"
 	"net/http"
+	"sync"
 	"time"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v5"
 )
 
 const maxErrCount = 3
-const httpClientTimeoutSec = 10
 
 // hook - структура веб хука
 type hook struct {
 	name     string
-	client   http.Client
+	client   *http.Client
 	service  *Service // Указатель на сервис родитель для проброса коннекта к БД
 	function HookFunc
+	opts     HookOptions
+	tls      *TLSConfig // Настройки TLS сервиса с учетом настроек хука
+
+	subClients map[string]*subClient  // Клиенты для подписчиков со своими настройками TLS, ключ - tlsKey
+	lanes      map[int64]*orderedLane // Очереди упорядоченной доставки, ключ - ID подписки
+	sync.Mutex
+
+	batches     map[int64]*pendingBatch // Копящиеся пачки событий в режиме HookOptions.Batch, ключ - ID подписки
+	batchMu     sync.Mutex
+	batchSendMu sync.Mutex // Порядок постановки пачек в очередь отправки
 }
 
-func newHook(name string, function HookFunc, parent *Service) *hook {
+func newHook(name string, function HookFunc, parent *Service, opts HookOptions) *hook {
 	if parent == nil {
 		return nil
 	}
 
-	if !validName(name) {
+	if !validHookName(name) {
 		log.Printf(hookErr, "", "invalid name'")
 		return nil
 	}
 
-	return &hook{
-		name:     name,
-		service:  parent,
-		client:   http.Client{Timeout: time.Second * httpClientTimeoutSec},
-		function: function,
+	h := &hook{
+		name:       name,
+		service:    parent,
+		function:   function,
+		opts:       opts,
+		tls:        mergeTLS(parent.cfg.DeliveryTLS, opts.TLS),
+		subClients: map[string]*subClient{},
+		lanes:      map[int64]*orderedLane{},
+		batches:    map[int64]*pendingBatch{},
 	}
+	h.client = h.newClient(h.tls)
+	return h
 }
 
-func (h *hook) trigger() (err error) {
+// trigger - Вызов хука. Возвращает ID события, который получат подписчики в заголовке X-Hook-Event-Id,
+// или пустую строку, если событие не нужно ни одному подписчику.
+// Если ev не задано, то событие формирует функция хука. Ошибки функции для отдельных подписчиков
+// не мешают отправке остальным и возвращаются вместе с ID события
+func (h *hook) trigger(ctx context.Context, ev *event) (eventID string, err error) {
 	// Загружаем инфу о подписчиках из БД
 	var s []*Subscriber
-	if s, err = h.loadSubs(); err != nil {
-		return err
+	if s, err = h.loadSubs(ctx); err != nil {
+		return "", err
 	}
 
 	// Если подписчиков нет, то и делать ничего не нужно
@@ -52,50 +75,263 @@ func (h *hook) trigger() (err error) {
 		return
 	}
 
-	// Выполняем функцию
-	form := h.function.Function()
-	if form == nil {
-		return fmt.Errorf("hook: name='%s' error='fuction for hook.trigger() not found", h.name)
+	// Выполняем функцию и оставляем только подписчиков, которым нужно это событие
+	var recipients []recipient
+	var funcErrs []error
+	if ev == nil && h.function.PerSubscriber != nil {
+		ev = newEvent(h.name, NewForm())
+		recipients, funcErrs = h.personalize(ctx, ev, s)
+	} else {
+		if ev == nil {
+			var form *Form
+			if h.function.Function != nil {
+				form = h.function.Function()
+			}
+			if form == nil {
+				return "", fmt.Errorf("hook: name='%s' error='fuction for hook.trigger() not found", h.name)
+			}
+			ev = newEvent(h.name, form)
+		}
+
+		for i := range s {
+			if s[i].accepts(ev.form) {
+				recipients = append(recipients, recipient{sub: s[i], ev: ev})
+			}
+		}
+	}
+
+	defer func() {
+		if err == nil && len(funcErrs) > 0 {
+			err = errors.Join(funcErrs...)
+		}
+	}()
+
+	// Как и без подписчиков, событие никому не отправляется и не сохраняется, поэтому ID не возвращается
+	if len(recipients) == 0 {
+		return "", nil
+	}
+
+	if err = h.service.saveEvent(ctx, ev); err != nil {
+		return "", err
+	}
+
+	if err = h.deliver(ctx, recipients); err != nil {
+		return "", err
+	}
+	return ev.id, nil
+}
+
+// deliver - Доставка сохраненного события получателям в зависимости от подписки и режима хука.
+// Подписчики-потоки и pull подписки получают событие через inbox, остальным отправляется запрос
+func (h *hook) deliver(ctx context.Context, recipients []recipient) (err error) {
+	var callbacks []recipient
+	for _, r := range recipients {
+		if !r.sub.isInbox() {
+			callbacks = append(callbacks, r)
+			continue
+		}
+		if err = h.service.pushInbox(ctx, r.sub, r.ev); err != nil {
+			log.Printf(hookErr, h.name, fmt.Sprintf("cannot push event to inbox url='%s': %v", r.sub.URL, err))
+			r.ev.tracker.fail()
+			err = nil
+		}
+	}
+
+	// Событие копится в пачке подписчика и уйдет вместе с другими
+	if h.opts.Batch != nil {
+		for _, r := range callbacks {
+			h.addToBatch(r.sub, r.ev)
+		}
+		return
+	}
+
+	tasks := make([]*sendTask, len(callbacks))
+	for i, r := range callbacks {
+		tasks[i] = newSendTask(r.sub, 1, r.ev)
+		r.ev.tracker.acquire()
+	}
+
+	// Ошибка возможна только до постановки отправок в очередь, поэтому ни одна из них не будет выполнена
+	if err = h.dispatch(ctx, tasks); err != nil {
+		for _, t := range tasks {
+			t.finish()
+		}
+	}
+	return
+}
+
+// recipient - Подписчик и событие, которое он получит
+type recipient struct {
+	sub *Subscriber
+	ev  *event
+}
+
+// personalize - Данные события для каждого подписчика из HookFunc.PerSubscriber. Подписчик пропускается,
+// если функция вернула nil или ошибку. Функция не вызывается для подписчиков, не подписанных на тип события
+// по умолчанию (имя хука): данные для них формировать незачем
+func (h *hook) personalize(ctx context.Context, ev *event, subs []*Subscriber) (recipients []recipient, errs []error) {
+	for _, sub := range subs {
+		if !sub.acceptsType(h.name) {
+			continue
+		}
+
+		form, err := h.function.PerSubscriber(ctx, sub)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("subscriber url='%s': %v", sub.URL, err))
+			continue
+		}
+		if form == nil {
+			continue
+		}
+
+		if form.Payload == nil {
+			form.Payload = map[string]string{}
+		}
+		if form.Event != "" && !validEventType(form.Event) {
+			errs = append(errs, fmt.Errorf("subscriber url='%s': incorrect event type='%s'", sub.URL, form.Event))
+			continue
+		}
+
+		if sub.accepts(form) {
+			recipients = append(recipients, recipient{sub: sub, ev: ev.personalize(form)})
+		}
+	}
+	return
+}
+
+// dispatch - Постановка отправок в очередь в зависимости от режима доставки хука
+func (h *hook) dispatch(ctx context.Context, tasks []*sendTask) (err error) {
+	if !h.opts.Ordered {
+		// Отправка обратных запросов подписчикам
+		for i := range tasks {
+			sendQueue.Push(tasks[i])
+		}
+		return
 	}
 
-	// Отправка обратных запросов подписчикам
-	for i := range s {
-		sendQueue.Push(newSendTask(s[i], form, false))
+	// Номера присваиваются до постановки в очередь, чтобы при ошибке БД не было пропусков у части подписчиков
+	for i := range tasks {
+		if tasks[i].seq, err = h.service.nextSeq(ctx, tasks[i].sub.ID); err != nil {
+			return
+		}
+	}
+	for i := range tasks {
+		h.enqueueOrdered(tasks[i])
 	}
 	return
 }
 
-func (h *hook) loadSubs() (s []*Subscriber, err error) {
+func (h *hook) loadSubs(ctx context.Context) (s []*Subscriber, err error) {
+	return h.querySubs(ctx, sqlSelectSubs, h.name, topicPrefixes(h.name))
+}
+
+// loadSub - Подписка по ID. Возвращает nil, если подписки нет или ее шаблон не подходит под имя хука
+func (h *hook) loadSub(ctx context.Context, id int64) (sub *Subscriber, err error) {
+	var s []*Subscriber
+	if s, err = h.querySubs(ctx, sqlSelectSubByID, id); err != nil || len(s) == 0 {
+		return nil, err
+	}
+	return s[0], nil
+}
+
+func (h *hook) querySubs(ctx context.Context, query string, args ...interface{}) (s []*Subscriber, err error) {
 	s = []*Subscriber{}
 
-	var rows *pgx.Rows
-	if rows, err = h.service.pg.Query(sqlSelectSubs, h.name); err != nil {
+	var rows pgx.Rows
+	if rows, err = h.service.pg.Query(ctx, h.service.query(query), args...); err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		tmp := &Subscriber{hook: h}
-		if err = rows.Scan(&tmp.URL, &tmp.Pass, &tmp.ErrCount); err != nil {
+		var authSecret, tlsSecret, headersSecret, urlSecret, signingSecret, signingPrev []byte
+		var signingPrevUntil time.Time
+		if err = rows.Scan(&tmp.ID, &tmp.URL, &tmp.Pass, &tmp.ErrCount, &tmp.EventTypes, &tmp.Filter, &tmp.Pattern, &tmp.Headers, &authSecret, &tlsSecret, &tmp.RateLimit, &tmp.RateBurst,
+			&tmp.Description, &tmp.ContactEmail, &tmp.Labels, &tmp.Metadata, &signingSecret, &signingPrev, &signingPrevUntil, &headersSecret, &urlSecret); err != nil {
 			return nil, err
 		}
+
+		// Из БД загружаются подписки по шаблонам с подходящим началом, здесь остаются только совпадающие с именем хука
+		if tmp.Pattern != "" && !matchTopic(tmp.Pattern, h.name) {
+			continue
+		}
+
+		// Фильтр проверяется при подписке, поэтому ошибка здесь означает, что строку изменили в обход сервиса
+		if tmp.filter, err = cachedFilter(tmp.Filter); err != nil {
+			log.Printf(hookErr, h.name, fmt.Sprintf("subscription url='%s' skipped, invalid filter: %v", tmp.URL, err))
+			err = nil
+			continue
+		}
+
+		if tmp.Auth, err = h.service.decryptAuth(authSecret); err != nil {
+			log.Printf(hookErr, h.name, fmt.Sprintf("subscription url='%s' skipped, cannot load auth: %v", tmp.URL, err))
+			err = nil
+			continue
+		}
+
+		// URL брокера с учетными данными хранится зашифрованным. Открытый URL, сохраненный до шифрования,
+		// используется для подключения, а в логи попадает без учетных данных
+		if len(urlSecret) > 0 {
+			var plain []byte
+			if plain, err = h.service.decryptSecret(urlSecret); err != nil {
+				log.Printf(hookErr, h.name, fmt.Sprintf("subscription url='%s' skipped, cannot load url: %v", tmp.URL, err))
+				err = nil
+				continue
+			}
+			tmp.sinkURL = string(plain)
+		} else if isSinkURL(tmp.URL) {
+			tmp.sinkURL, tmp.URL = tmp.URL, redactURL(tmp.URL)
+		}
+
+		// Без headers_secret остаются открытые заголовки из колонки headers, сохраненные до шифрования
+		if len(headersSecret) > 0 {
+			if tmp.Headers, err = h.service.decryptHeaders(headersSecret); err != nil {
+				log.Printf(hookErr, h.name, fmt.Sprintf("subscription url='%s' skipped, cannot load headers: %v", tmp.URL, err))
+				err = nil
+				continue
+			}
+		}
+
+		if tmp.TLS, err = h.service.decryptTLS(tlsSecret); err != nil {
+			log.Printf(hookErr, h.name, fmt.Sprintf("subscription url='%s' skipped, cannot load tls: %v", tmp.URL, err))
+			err = nil
+			continue
+		}
+
+		if tmp.signing, err = h.service.decryptSigning(signingSecret, signingPrev, signingPrevUntil); err != nil {
+			log.Printf(hookErr, h.name, fmt.Sprintf("subscription url='%s' skipped, cannot load signing secret: %v", tmp.URL, err))
+			err = nil
+			continue
+		}
 		s = append(s, tmp)
 	}
-	return
+	return s, rows.Err()
 }
 
-func newRequest(sub *Subscriber, form *Form) (req *http.Request, err error) {
-	data, contentType, err := form.Data()
+func newRequest(ctx context.Context, task *sendTask) (req *http.Request, err error) {
+	sub := task.sub
+	method := sub.hook.opts.method()
+
+	var data *bytes.Buffer
+	var contentType string
+	if task.batchID != "" {
+		data, contentType, err = sub.hook.opts.Batch.body(task.events)
+	} else {
+		data, contentType, err = task.events[0].form.Data()
+	}
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	switch form {
-	case nil:
-		req, _ = http.NewRequest(http.MethodPost, sub.URL, nil)
-	default:
-		req, _ = http.NewRequest(http.MethodPost, sub.URL, data)
-		req.Header.Set("Content-Type", contentType)
+	body := data.Bytes()
+	req, _ = http.NewRequestWithContext(ctx, method, sub.URL, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	task.setHeaders(req.Header)
+	sub.signing.sign(req.Header, body, time.Now())
+
+	if err = sub.applyAuth(req); err != nil {
+		return nil, err
 	}
 	return
 }
@@ -107,21 +343,32 @@ func NewHookFuncMap() *HookFuncMap {
 }
 
 func (h HookFuncMap) Add(name string, function func() *Form) {
-	h[name] = HookFunc{name, function}
+	h[name] = HookFunc{Name: name, Function: function}
+}
+
+// AddPerSubscriber - Добавление функции, которая формирует данные события отдельно для каждого подписчика
+func (h HookFuncMap) AddPerSubscriber(name string, function SubscriberFunc) {
+	h[name] = HookFunc{Name: name, PerSubscriber: function}
 }
 
 func (h HookFuncMap) Delete(name string) {
 	delete(h, name)
 }
 
+// SubscriberFunc - Данные события для подписчика sub. (nil, nil) - подписчик не получит событие,
+// ошибка - тоже, но она будет залогирована и возвращена из TriggerHook с адресом подписчика
+type SubscriberFunc func(ctx context.Context, sub *Subscriber) (*Form, error)
+
 type HookFunc struct {
-	Name     string
-	Function func() *Form
+	Name          string
+	Function      func() *Form
+	PerSubscriber SubscriberFunc // Если задана, то вызывается вместо Function для каждого подписчика
 }
 
 type Form struct {
 	Payload     map[string]string
 	ContentType string
+	Event       string // Тип события. Если не задан, то типом события считается имя хука
 }
 
 func NewForm() *Form {
@@ -131,6 +378,24 @@ func NewForm() *Form {
 	}
 }
 
+// formFromJSON - Данные события из JSON объекта. Строки передаются как есть, null - пустой строкой,
+// остальные значения - в виде JSON
+func formFromJSON(event string, payload map[string]json.RawMessage) *Form {
+	form := NewForm()
+	form.SetEvent(event)
+	for k, v := range payload {
+		var str string
+		switch {
+		case string(v) == "null":
+		case json.Unmarshal(v, &str) == nil:
+		default:
+			str = string(v)
+		}
+		form.Add(k, str)
+	}
+	return form
+}
+
 func (f *Form) Data() (buf *bytes.Buffer, ContentType string, err error) {
 	buf = &bytes.Buffer{}
 	w := multipart.NewWriter(buf)
@@ -149,3 +414,15 @@ func (f *Form) Data() (buf *bytes.Buffer, ContentType string, err error) {
 func (f *Form) Add(key, value string) {
 	f.Payload[key] = value
 }
+
+// SetEvent - Установка типа события, по которому подписчики фильтруют уведомления
+func (f *Form) SetEvent(event string) {
+	f.Event = event
+}
+
+func (f *Form) eventType(hookName string) string {
+	if f.Event == "" {
+		return hookName
+	}
+	return f.Event
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	u "net/url"
+	"time"
+)
+
+const httpClientTimeoutSec = 10
+
+// Значения по умолчанию для HookOptions
+const (
+	defaultMaxRedirects         = 10
+	defaultMaxResponseBodyBytes = 64 << 10 // 64Кб
+)
+
+// Политики перенаправлений исходящих запросов
+const (
+	RedirectFollow   = "follow"    // Следовать перенаправлениям (по умолчанию)
+	RedirectNone     = "none"      // Не следовать, ответ 3xx считается результатом отправки
+	RedirectSameHost = "same-host" // Следовать только перенаправлениям на тот же хост
+)
+
+// HookOptions - Дополнительные настройки хука. Нулевые значения означают настройки по умолчанию
+type HookOptions struct {
+	TLS *TLSConfig // Настройки TLS отправок этого хука, переопределяют Config.DeliveryTLS
+
+	Timeout        time.Duration // Таймаут запроса к подписчику целиком. По умолчанию 10 секунд
+	Method         string        // POST (по умолчанию), PUT или PATCH
+	RedirectPolicy string        // RedirectFollow (по умолчанию), RedirectNone или RedirectSameHost
+	MaxRedirects   int           // Максимальное количество перенаправлений. По умолчанию 10
+
+	ProxyURL string // Прокси для отправок (http, https, socks5). По умолчанию берется из HTTP_PROXY/HTTPS_PROXY
+	NoProxy  bool   // Не использовать прокси, даже если он задан в окружении
+
+	MaxIdleConns        int           // Максимальное количество простаивающих соединений хука
+	MaxIdleConnsPerHost int           // Максимальное количество простаивающих соединений с одним хостом
+	MaxConnsPerHost     int           // Максимальное количество соединений с одним хостом, 0 - без ограничений
+	IdleConnTimeout     time.Duration // Время простоя соединения, после которого оно закрывается
+	DisableKeepAlives   bool          // Новое соединение на каждый запрос
+
+	MaxResponseBodyBytes int64 // Сколько байт ответа подписчика читать. По умолчанию 64Кб
+
+	Ordered      bool          // Доставлять события каждому подписчику строго по очереди, см. orderedLane
+	MaxAttempts  int           // Попыток доставки события в режиме Ordered до переноса в dead letters. По умолчанию 5
+	RetryBackoff time.Duration // Пауза перед второй попыткой в режиме Ordered, далее удваивается до 1 минуты. По умолчанию 1 секунда
+
+	Batch *BatchOptions // Отправлять события подписчику пачками, nil - по одному
+}
+
+func (o *HookOptions) validate() (err error) {
+	if o.TLS != nil {
+		if err = o.TLS.validate(true); err != nil {
+			return
+		}
+	}
+
+	if o.Batch != nil {
+		if err = o.Batch.validate(); err != nil {
+			return
+		}
+	}
+
+	switch o.Method {
+	case "", http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return fmt.Errorf("unsupported method '%s'", o.Method)
+	}
+
+	switch o.RedirectPolicy {
+	case "", RedirectFollow, RedirectNone, RedirectSameHost:
+	default:
+		return fmt.Errorf("unsupported redirect policy '%s'", o.RedirectPolicy)
+	}
+
+	if o.Timeout < 0 || o.IdleConnTimeout < 0 || o.MaxRedirects < 0 || o.MaxIdleConns < 0 ||
+		o.MaxIdleConnsPerHost < 0 || o.MaxConnsPerHost < 0 || o.MaxResponseBodyBytes < 0 ||
+		o.MaxAttempts < 0 || o.RetryBackoff < 0 {
+		return fmt.Errorf("negative values are not allowed")
+	}
+
+	if o.ProxyURL != "" {
+		if o.NoProxy {
+			return fmt.Errorf("ProxyURL and NoProxy are mutually exclusive")
+		}
+
+		var proxy *u.URL
+		if proxy, err = u.Parse(o.ProxyURL); err != nil {
+			return fmt.Errorf("invalid proxy url: %v", err)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme '%s'", proxy.Scheme)
+		}
+	}
+	return
+}
+
+func (o *HookOptions) method() string {
+	if o.Method == "" {
+		return http.MethodPost
+	}
+	return o.Method
+}
+
+func (o *HookOptions) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return time.Second * httpClientTimeoutSec
+	}
+	return o.Timeout
+}
+
+func (o *HookOptions) maxResponseBodyBytes() int64 {
+	if o.MaxResponseBodyBytes == 0 {
+		return defaultMaxResponseBodyBytes
+	}
+	return o.MaxResponseBodyBytes
+}
+
+// checkRedirect - Политика перенаправлений для http.Client
+func (o *HookOptions) checkRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects := o.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+
+	switch o.RedirectPolicy {
+	case RedirectNone:
+		return http.ErrUseLastResponse
+	case RedirectSameHost:
+		if req.URL.Host != via[0].URL.Host {
+			return fmt.Errorf("redirect to another host '%s' is not allowed", req.URL.Host)
+		}
+	}
+
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	return nil
+}
+
+// transport - Шаблон транспорта хука без настроек TLS
+func (o *HookOptions) transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	switch {
+	case o.NoProxy:
+		t.Proxy = nil
+	case o.ProxyURL != "":
+		proxy, _ := u.Parse(o.ProxyURL) // Проверен в validate
+		t.Proxy = http.ProxyURL(proxy)
+	}
+
+	if o.MaxIdleConns > 0 {
+		t.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if o.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = o.MaxConnsPerHost
+	}
+	if o.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = o.IdleConnTimeout
+	}
+	t.DisableKeepAlives = o.DisableKeepAlives
+	return t
+}
+
+func (h *hook) newClient(tlsCfg *TLSConfig) *http.Client {
+	client := &http.Client{
+		Timeout:       h.opts.timeout(),
+		CheckRedirect: h.opts.checkRedirect,
+	}
+
+	if tlsCfg == nil {
+		client.Transport = h.opts.transport()
+	} else {
+		client.Transport = newTLSTransport(tlsCfg, h.opts.transport())
+	}
+	return client
+}
+
+// Клиентов с настройками TLS подписчиков у одного хука. При превышении закрывается давно не использованный
+const maxSubClients = 64
+
+// subClient - Клиент с настройками TLS подписчика и время его последнего использования
+type subClient struct {
+	client *http.Client
+	used   time.Time
+}
+
+// clientFor - HTTP клиент для отправки подписчику с учетом его настроек TLS.
+// Подписки с одинаковыми настройками используют один клиент, поэтому клиенты не удаляются при отписке,
+// а вытесняются давно не использованные, когда их становится больше maxSubClients
+func (h *hook) clientFor(sub *Subscriber) *http.Client {
+	if sub == nil || sub.TLS == nil {
+		return h.client
+	}
+
+	cfg := mergeTLS(h.tls, clampSubscriberTLS(sub.TLS))
+	key := tlsKey(cfg)
+
+	h.Lock()
+	defer h.Unlock()
+	c := h.subClients[key]
+	if c == nil {
+		if len(h.subClients) >= maxSubClients {
+			h.evictSubClient()
+		}
+		c = &subClient{client: h.newClient(cfg)}
+		h.subClients[key] = c
+	}
+	c.used = time.Now()
+	return c.client
+}
+
+// evictSubClient - Удаление давно не использованного клиента. Запросы, которые он выполняет, завершатся,
+// закрываются только простаивающие соединения. Вызывается под h.Lock
+func (h *hook) evictSubClient() {
+	var oldest string
+	for key, c := range h.subClients {
+		if oldest == "" || c.used.Before(h.subClients[oldest].used) {
+			oldest = key
+		}
+	}
+	if c := h.subClients[oldest]; c != nil {
+		c.client.CloseIdleConnections()
+		delete(h.subClients, oldest)
+	}
+}
+
+// readResponse - Чтение не более MaxResponseBodyBytes байт ответа и закрытие тела.
+// Остаток (не больше того же лимита) вычитывается впустую, чтобы соединение могло вернуться в пул
+func (h *hook) readResponse(resp *http.Response) (body []byte) {
+	defer resp.Body.Close()
+	body, _ = io.ReadAll(io.LimitReader(resp.Body, h.opts.maxResponseBodyBytes()))
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, h.opts.maxResponseBodyBytes()))
+	return
+}
+
+// Сколько символов ответа подписчика попадает в лог
+const maxLoggedBody = 256
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "..."
+	}
+	return s
+}
@@ -1,13 +1,25 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	u "net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Ошибки проверки pass_code, по ним считаются попытки подбора
+var (
+	errInvalidPassCode = errors.New("invalid pass_code")
+	errSubNotExists    = errors.New("subscription not exists")
 )
 
 // hookPool - пул веб-хуков
@@ -25,8 +37,12 @@ func newHookPool(parent *Service) *hookPool {
 	}
 }
 
-func (h *hookPool) add(hook *hook) {
-	err := h.createHook(hook.name, hook.function.Name)
+func (h *hookPool) add(ctx context.Context, hook *hook) {
+	if hook == nil {
+		return
+	}
+
+	err := h.createHook(ctx, hook.name, hook.function.Name)
 	if err != nil {
 		log.Println(err)
 		return
@@ -41,8 +57,8 @@ func (h *hookPool) addNoDB(hook *hook) {
 	h.hooks[hook.name] = hook
 }
 
-func (h *hookPool) delete(name string) {
-	err := h.deleteHook(name)
+func (h *hookPool) delete(ctx context.Context, name string) {
+	err := h.deleteHook(ctx, name)
 	if err != nil {
 		log.Println(err)
 		return
@@ -53,65 +69,267 @@ func (h *hookPool) delete(name string) {
 	delete(h.hooks, name)
 }
 
-func (h *hookPool) triggerByName(name string) {
+func (h *hookPool) exists(name string) bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.hooks[name] != nil
+}
+
+// names - Имена хуков пула
+func (h *hookPool) names() (names []string) {
 	h.Lock()
 	defer h.Unlock()
-	if h.hooks[name] != nil {
-		if err := h.hooks[name].trigger(); err != nil {
-			log.Printf(hookErr, name, err)
+	for name := range h.hooks {
+		names = append(names, name)
+	}
+	return
+}
+
+// triggerByName - Вызов хука по имени. Хук вызывается без блокировки пула: загрузка подписчиков,
+// функция хука и выдача порядковых номеров обращаются к БД и не должны задерживать вызовы других хуков
+func (h *hookPool) triggerByName(ctx context.Context, name string, ev *event) (eventID string, err error) {
+	h.Lock()
+	hook := h.hooks[name]
+	h.Unlock()
+
+	if hook == nil {
+		err = fmt.Errorf(hookErr, name, "this hook not exists")
+		log.Println(err)
+		return
+	}
+
+	if eventID, err = hook.trigger(ctx, ev); err != nil {
+		log.Printf(hookErr, name, err)
+	}
+	return
+}
+
+// stopBatches - Отправка накопленных пачек всех хуков при остановке сервиса
+func (h *hookPool) stopBatches(ctx context.Context) {
+	h.Lock()
+	hooks := make([]*hook, 0, len(h.hooks))
+	for _, hook := range h.hooks {
+		hooks = append(hooks, hook)
+	}
+	h.Unlock()
+
+	for _, hook := range hooks {
+		if hook.opts.Batch != nil {
+			hook.stopBatches(ctx)
 		}
-	} else {
-		log.Printf(hookErr, name, "this hook not exists")
 	}
 }
 
-func (h *hookPool) createHook(name string, functionName string) (err error) {
-	if _, err = h.parent.pg.Exec(sqlAddHook, name, functionName); err != nil {
+func (h *hookPool) createHook(ctx context.Context, name string, functionName string) (err error) {
+	if _, err = h.parent.pg.Exec(ctx, h.parent.query(sqlAddHook), name, functionName); err != nil {
 		return fmt.Errorf(hookErr, name, err.Error())
 	}
 	return
 }
 
-func (h *hookPool) deleteHook(name string) (err error) {
-	if _, err = h.parent.pg.Exec(sqlDeleteHook, name); err != nil {
+func (h *hookPool) deleteHook(ctx context.Context, name string) (err error) {
+	if _, err = h.parent.pg.Exec(ctx, h.parent.query(sqlDeleteHook), name); err != nil {
 		return fmt.Errorf(hookErr, name, err.Error())
 	}
 	return
 }
 
 func (h *hookPool) checkSubArgs(name, url, passCode string) (err error) {
-	if !validName(name) {
-		return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter name='%s'", name))
-	}
+	if isTopicPattern(name) {
+		if !validTopicPattern(name) {
+			return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter name='%s'", name))
+		}
+	} else {
+		if !validHookName(name) {
+			return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter name='%s'", name))
+		}
 
-	if h.hooks[name] == nil {
-		return fmt.Errorf(hookErr, name, "this hook not exists")
+		h.Lock()
+		exists := h.hooks[name] != nil
+		h.Unlock()
+		if !exists {
+			return fmt.Errorf(hookErr, name, "this hook not exists")
+		}
 	}
 
-	_, err = u.Parse(url)
+	var parsed *u.URL
+	parsed, err = u.Parse(url)
 	if err != nil {
 		return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter url='%s', error='%v'", url, err))
 	}
 
+	// У подписок с inbox вместо адреса идентификатор клиента: stream://<client-id>, pull://<id>
+	if (parsed.Scheme == streamScheme || parsed.Scheme == pullScheme) &&
+		(!validClientID(parsed.Host) || url != parsed.Scheme+"://"+parsed.Host) {
+		return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter url='%s', expected %s://<client-id>", url, parsed.Scheme))
+	}
+
 	if passCode != "" {
 		_, err = uuid.Parse(passCode)
 		if err != nil {
-			return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter pass_code='%s', error='%v'", url, err))
+			return fmt.Errorf(hookErr, name, "incorrect parameter pass_code")
 		}
 	}
 
 	return nil
 }
 
-func (h *hookPool) subscribe(name string, url string) (passCode string, err error) {
+func checkSubOptions(name string, opts *SubscribeOptions) (err error) {
+	for _, t := range opts.EventTypes {
+		if !validEventType(t) {
+			return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter event_type='%s'", t))
+		}
+	}
+
+	if _, err = parseFilter(opts.Filter); err != nil {
+		return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter filter='%s', error='%v'", opts.Filter, err))
+	}
+
+	if err = validateHeaders(opts.Headers); err != nil {
+		return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter headers, error='%v'", err))
+	}
+
+	if opts.Auth != nil {
+		if err = opts.Auth.validate(); err != nil {
+			return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter auth, error='%v'", err))
+		}
+	}
+
+	if opts.TLS != nil {
+		if err = opts.TLS.validate(false); err != nil {
+			return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter tls, error='%v'", err))
+		}
+		opts.TLS = clampSubscriberTLS(opts.TLS)
+	}
+
+	if err = validateRateLimit(opts.RateLimit, opts.RateBurst); err != nil {
+		return fmt.Errorf(hookErr, name, err.Error())
+	}
+
+	if err = opts.validateMetadata(); err != nil {
+		return fmt.Errorf(hookErr, name, err.Error())
+	}
+
+	if err = validateLease(opts.Lease); err != nil {
+		return fmt.Errorf(hookErr, name, err.Error())
+	}
+
+	if err = validateSigningSecret(opts.SigningSecret); err != nil {
+		return fmt.Errorf(hookErr, name, err.Error())
+	}
+	return
+}
+
+func (h *hookPool) subscribe(ctx context.Context, name string, url string, opts *SubscribeOptions) (passCode string, err error) {
 	if err = h.checkSubArgs(name, url, ""); err != nil {
 		return "", err
 	}
 
-	passCode = uuid.New().String()
-	_, err = h.parent.pg.Exec(sqlSubscribe, name, url, passCode)
+	if opts == nil {
+		opts = &SubscribeOptions{}
+	}
+
+	if err = checkSubOptions(name, opts); err != nil {
+		return "", err
+	}
+
+	eventTypes := opts.EventTypes
+	if eventTypes == nil {
+		eventTypes = []string{}
+	}
+
+	labels := opts.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+
+	metadata := opts.Metadata
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+
+	var authType string
+	var authSecret []byte
+	if opts.Auth != nil {
+		authType = opts.Auth.Type
+		if authSecret, err = json.Marshal(opts.Auth); err != nil {
+			return "", err
+		}
+		if authSecret, err = h.parent.encryptSecret(authSecret); err != nil {
+			return "", fmt.Errorf(hookErr, name, err)
+		}
+	}
+
+	// Учетные данные брокера из URL хранятся зашифрованными
+	var storedURL string
+	var urlSecret []byte
+	if storedURL, urlSecret, err = h.parent.sinkStoredURL(url); err != nil {
+		return "", fmt.Errorf(hookErr, name, err)
+	}
+
+	// Заголовки могут содержать ключи API, поэтому хранятся зашифрованными, а колонка headers остается пустой
+	var headersSecret []byte
+	if len(opts.Headers) > 0 {
+		if headersSecret, err = json.Marshal(opts.Headers); err != nil {
+			return "", err
+		}
+		if headersSecret, err = h.parent.encryptSecret(headersSecret); err != nil {
+			return "", fmt.Errorf(hookErr, name, err)
+		}
+	}
+
+	var tlsSecret []byte
+	if opts.TLS != nil {
+		if tlsSecret, err = json.Marshal(opts.TLS); err != nil {
+			return "", err
+		}
+		if tlsSecret, err = h.parent.encryptSecret(tlsSecret); err != nil {
+			return "", fmt.Errorf(hookErr, name, err)
+		}
+	}
+
+	var signingSecret []byte
+	if opts.SigningSecret != "" {
+		if signingSecret, err = h.parent.encryptSecret([]byte(opts.SigningSecret)); err != nil {
+			return "", fmt.Errorf(hookErr, name, err)
+		}
+	}
+
+	query := sqlSubscribe
+	if isTopicPattern(name) {
+		query = sqlSubscribePattern
+		if len(h.matchingHooks(name)) == 0 {
+			log.Printf(hookWarning, name, "pattern does not match any hook yet")
+		}
+	}
+
+	if url == "" {
+		return "", fmt.Errorf(hookErr, name, "incorrect parameter url, use pull subscription for subscriptions without url")
+	}
+
+	if isInboxURL(url) && (opts.Auth != nil || opts.TLS != nil || len(opts.Headers) > 0 || opts.SigningSecret != "") {
+		return "", fmt.Errorf(hookErr, name, "auth, tls, headers and signing are not supported for stream and pull subscriptions")
+	}
+
+	if isSinkURL(url) && (opts.Auth != nil || opts.TLS != nil) {
+		return "", fmt.Errorf(hookErr, name, "auth and tls are not supported for broker subscriptions, set credentials in url")
+	}
+
+	host := urlHost(url)
+	if err = h.checkSubLimits(ctx, name, host); err != nil {
+		return "", err
+	}
+
+	// В БД хранится только хеш pass_code
+	var passCodeHash string
+	if passCode, passCodeHash, err = newPassCode(); err != nil {
+		return "", err
+	}
+	_, err = h.parent.pg.Exec(ctx, h.parent.query(query), name, storedURL, passCodeHash, eventTypes, opts.Filter, map[string]string{}, authType, authSecret, tlsSecret, opts.RateLimit, opts.RateBurst, host,
+		opts.Description, opts.ContactEmail, labels, metadata, int(opts.Lease/time.Second), signingSecret, headersSecret, urlSecret)
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
 			err = fmt.Errorf("subscription allready exists")
 		}
 		return "", err
@@ -120,31 +338,112 @@ func (h *hookPool) subscribe(name string, url string) (passCode string, err erro
 	return
 }
 
-func (h *hookPool) unsubscribe(name, url, passCode string) (err error) {
-	if err = h.checkSubArgs(name, url, passCode); err != nil {
+// checkSubLimits - Проверка ограничений количества подписок из Config.Inbound.
+// Проверка не атомарна с добавлением, поэтому при одновременных подписках лимит может быть немного превышен
+func (h *hookPool) checkSubLimits(ctx context.Context, name, host string) (err error) {
+	limits := h.parent.cfg.Inbound
+	if limits == nil {
+		return
+	}
+
+	var count int
+	if limits.MaxSubsPerHook > 0 {
+		if err = h.parent.pg.QueryRow(ctx, h.parent.query(sqlCountHookSubs), name).Scan(&count); err != nil {
+			return
+		}
+		if count >= limits.MaxSubsPerHook {
+			return fmt.Errorf(hookErr, name, "subscriptions limit for hook exceeded")
+		}
+	}
+
+	if limits.MaxSubsPerHost > 0 {
+		if err = h.parent.pg.QueryRow(ctx, h.parent.query(sqlCountHostSubs), host).Scan(&count); err != nil {
+			return
+		}
+		if count >= limits.MaxSubsPerHost {
+			return fmt.Errorf(hookErr, name, fmt.Sprintf("subscriptions limit for host '%s' exceeded", host))
+		}
+	}
+	return
+}
+
+// urlHost - Хост URL подписки в нижнем регистре
+func urlHost(url string) string {
+	parsed, err := u.Parse(url)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+func (h *hookPool) unsubscribe(ctx context.Context, name, url, passCode string) (err error) {
+	var id int64
+	if id, err = h.checkPassCode(ctx, name, url, passCode); err != nil {
+		return
+	}
+
+	var authSecret []byte
+	// Подписку могли удалить между проверкой и удалением, результат для вызывающего тот же
+	err = h.parent.pg.QueryRow(ctx, h.parent.query(sqlUnsubscribe), id).Scan(&authSecret)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
+	h.parent.limits.forget(id)
 
-	// Перед удалением нужно проверить, а есть ли вообще такая подписка,
+	// Токен OAuth2 удаленной подписки больше не нужен. Ошибка расшифровки не мешает отписке:
+	// токен тогда удалится из кеша, когда истечет
+	if auth, authErr := h.parent.decryptAuth(authSecret); authErr == nil {
+		h.parent.tokens.invalidate(auth)
+	}
+
+	return
+}
+
+// checkPassCode - Проверка pass_code подписки. Возвращает ID подписки
+func (h *hookPool) checkPassCode(ctx context.Context, name, url, passCode string) (id int64, err error) {
+	if err = h.checkSubArgs(name, url, passCode); err != nil {
+		return 0, err
+	}
+
+	// Сначала нужно проверить, а есть ли вообще такая подписка,
 	// потому что при удалении несуществующей строки ошибка не возникает
-	row := h.parent.pg.QueryRow(sqlSelectSubCode, name, url)
-	var pgPassCode string
-	err = row.Scan(&pgPassCode)
+	row := h.parent.pg.QueryRow(ctx, h.parent.query(sqlSelectSubCode), name, h.parent.lookupURL(url))
+	var current string
+	err = row.Scan(&id, &current)
 	if err != nil {
-		if strings.Contains(err.Error(), "no rows in result set") {
-			err = fmt.Errorf("subscription not exists")
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = errSubNotExists
 		}
 		return
 	}
 
-	if pgPassCode != passCode {
-		return fmt.Errorf("invalid pass_code")
+	// После ротации действует только новый pass_code: иначе утекший прежний позволил бы снова выполнить ротацию
+	// и отобрать подписку у владельца
+	if !matchPassCode(current, passCode) {
+		return 0, errInvalidPassCode
 	}
+	return
+}
 
-	_, err = h.parent.pg.Exec(sqlUnsubscribe, name, url, passCode)
-	if err != nil {
+// setRateLimit - Изменение ограничения частоты отправок подписчику
+func (h *hookPool) setRateLimit(ctx context.Context, name, url string, limit float64, burst int) (err error) {
+	if err = h.checkSubArgs(name, url, ""); err != nil {
 		return err
 	}
 
+	if err = validateRateLimit(limit, burst); err != nil {
+		return fmt.Errorf(hookErr, name, err.Error())
+	}
+
+	var tag pgconn.CommandTag
+	if tag, err = h.parent.pg.Exec(ctx, h.parent.query(sqlSetSubRateLimit), name, h.parent.lookupURL(url), limit, burst); err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("subscription not exists")
+	}
 	return
 }
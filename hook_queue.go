@@ -1,10 +1,15 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func init() {
@@ -13,14 +18,21 @@ func init() {
 
 var sendQueue = NewTaskQueue()
 
-func newSendTask(sub *Subscriber, form *Form, repeating bool) *sendTask {
-	return &sendTask{sub: sub, form: form, repeating: repeating}
+func newSendTask(sub *Subscriber, attempt int, events ...*event) *sendTask {
+	return &sendTask{sub: sub, events: events, attempt: attempt}
 }
 
-type SendTaskQueue []*sendTask
+// SendTaskQueue - Общая очередь отправок хуков без упорядоченной доставки
+type SendTaskQueue struct {
+	tasks []*sendTask
+	cond  *sync.Cond
+	sync.Mutex
+}
 
 func NewTaskQueue() *SendTaskQueue {
-	return &SendTaskQueue{}
+	q := &SendTaskQueue{}
+	q.cond = sync.NewCond(&q.Mutex)
+	return q
 }
 
 func (q *SendTaskQueue) Run() {
@@ -31,7 +43,7 @@ func (q *SendTaskQueue) Run() {
 			continue
 		}
 
-		err = i.Execute()
+		err = i.Execute(i.sub.hook.service.ctx)
 		if err != nil {
 			log.Printf("send queue: error='cannot send request hook_name='%s', url=%s, err='%v'", i.sub.hook.name, i.sub.URL, err)
 		}
@@ -40,86 +52,285 @@ func (q *SendTaskQueue) Run() {
 }
 
 func (q *SendTaskQueue) Push(i *sendTask) {
-	*q = append(*q, i)
+	q.Lock()
+	q.tasks = append(q.tasks, i)
+	q.Unlock()
+	q.cond.Signal()
 }
 
+// PushAfter - Постановка задачи в очередь через время d
+func (q *SendTaskQueue) PushAfter(i *sendTask, d time.Duration) {
+	if d <= 0 {
+		q.Push(i)
+		return
+	}
+	time.AfterFunc(d, func() { q.Push(i) })
+}
+
+// Pop - Извлечение первой задачи. Если очередь пуста, то ждет появления задачи
 func (q *SendTaskQueue) Pop() (i *sendTask) {
-	if len(*q) == 0 {
-		return nil
+	q.Lock()
+	defer q.Unlock()
+	for len(q.tasks) == 0 {
+		q.cond.Wait()
 	}
 
-	h := *q
-	i, *q = h[0], h[1:]
+	i, q.tasks = q.tasks[0], q.tasks[1:]
 	return i
 }
 
+// deliveryOutcome - Результат одной попытки доставки
+type deliveryOutcome int
+
+const (
+	deliveryDelivered deliveryOutcome = iota // Подписчик ответил 2xx
+	deliveryRejected                         // Подписчик ответил 4xx, т.е. URL подписки некорректен
+	deliveryRetryable                        // Подписчик ответил 5xx или недоступен, имеет смысл повторить позже
+	deliveryThrottled                        // Подписчик ответил 429, повторить после Retry-After. Подписка не удаляется
+	deliveryFailed                           // Прочие ошибки
+)
+
 type sendTask struct {
-	sub       *Subscriber
-	form      *Form
-	repeating bool
+	sub     *Subscriber
+	events  []*event // Без HookOptions.Batch всегда одно событие
+	batchID string   // ID пачки событий в режиме HookOptions.Batch, иначе пустой
+	attempt int      // Номер попытки доставки, начиная с 1
+	seq     int64    // Порядковый номер отправки у подписчика в режиме HookOptions.Ordered, иначе 0
+	lastErr string   // Причина неудачи последней попытки
+
+	retryAfter time.Duration // Пауза до повтора, которую запросил подписчик в последнем ответе
+	throttled  int           // Сколько раз подряд подписчик ответил 429
+	throttledN int           // Сколько всего попыток получили 429. Они не считаются неудачными
+	delivered  bool          // Последняя попытка доставила события
+}
+
+// failures - Номер попытки без учета попыток, на которые подписчик ответил 429
+func (s *sendTask) failures() int {
+	return s.attempt - s.throttledN
+}
+
+// repeating - Является ли отправка повторной после неудачной попытки. Повторы после 429 не учитываются,
+// иначе первая же ошибка после них сразу увеличивала бы счетчик ошибок подписки
+func (s *sendTask) repeating() bool {
+	return s.failures() > 1
+}
+
+// retry - Повторная отправка того же события
+func (s *sendTask) retry() *sendTask {
+	t := newSendTask(s.sub, s.attempt+1, s.events...)
+	t.batchID, t.seq, t.throttled, t.throttledN = s.batchID, s.seq, s.throttled, s.throttledN
+	return t
+}
+
+// finish - Доставка событий отправки завершена: доставлены, перенесены в dead letters или отброшены
+func (s *sendTask) finish() {
+	finishEvents(s.events, s.delivered)
+}
+
+// finishEvents - Завершение доставки событий одному подписчику
+func finishEvents(events []*event, delivered bool) {
+	for _, e := range events {
+		e.tracker.release(delivered)
+	}
+}
+
+// deliveryTracker - Ожидание завершения доставки события всем подписчикам. pending - число незавершенных
+// доставок и удержание тем, кто ставит событие в очередь; когда оно доходит до 0, вызывается done
+type deliveryTracker struct {
+	pending atomic.Int32
+	failed  atomic.Bool       // Хотя бы одному подписчику событие не доставлено
+	done    func(failed bool) // Вызывается один раз, когда доставка завершилась у всех подписчиков
+}
+
+// newDeliveryTracker - Ожидание доставки, которое удерживает создавший его до вызова release
+func newDeliveryTracker(done func(failed bool)) *deliveryTracker {
+	t := &deliveryTracker{done: done}
+	t.pending.Store(1)
+	return t
 }
 
-func (s *sendTask) Execute() (err error) {
+// acquire - Начало доставки события одному подписчику
+func (t *deliveryTracker) acquire() {
+	if t != nil {
+		t.pending.Add(1)
+	}
+}
+
+// fail - Событие не удалось доставить подписчику, которому оно не ставилось в очередь (например, через inbox)
+func (t *deliveryTracker) fail() {
+	if t != nil {
+		t.failed.Store(true)
+	}
+}
+
+// release - Доставка подписчику завершена. Последняя завершенная доставка вызывает done
+func (t *deliveryTracker) release(delivered bool) {
+	if t == nil {
+		return
+	}
+	if !delivered {
+		t.failed.Store(true)
+	}
+	if t.pending.Add(-1) == 0 {
+		t.done(t.failed.Load())
+	}
+}
+
+// Execute - Отправка без гарантии порядка. Повтор ставится в конец общей очереди
+func (s *sendTask) Execute(ctx context.Context) (err error) {
+	// Доставка завершена, если отправка не поставлена в очередь повторно
+	requeued := false
+	defer func() {
+		if !requeued {
+			s.finish()
+		}
+	}()
+
 	// Если превышен счетчик отправок у подписчика, то автоматически отписываем его (удаляем из БД)
 	if s.sub.ErrCount >= maxErrCount {
-		s.sub.incErrCount()
+		s.sub.incErrCount(ctx)
+		return
+	}
+
+	// Ограничение частоты: отправка откладывается, не занимая очередь
+	if wait := s.sub.hook.service.limits.reserve(s.sub); wait > 0 {
+		sendQueue.PushAfter(s, wait)
+		requeued = true
+		return
+	}
+
+	outcome, err := s.send(ctx)
+	switch outcome {
+	case deliveryDelivered:
+		// При положительном ответе сбрасываем счетчик ошибок обратно до 0
+		s.sub.resetErrCount(ctx)
 		return
+	case deliveryThrottled:
+		// 429 означает, что подписчик работает, но не успевает. Ошибкой подписки это не считается
+		if s.throttled >= maxThrottledRetries {
+			log.Printf(hookWarning, s.sub.hook.name, fmt.Sprintf("event dropped for url='%s' after %d throttled retries", s.sub.URL, s.throttled))
+			return nil
+		}
+		sendQueue.PushAfter(s.retry(), s.throttleDelay())
+		requeued = true
+		return nil
 	}
 
+	// Если это повторная отправка и она снова не удалась - увеличиваем счетчик ошибок
+	if s.repeating() {
+		s.sub.incErrCount(ctx)
+		return nil
+	}
+
+	switch outcome {
+	case deliveryRejected:
+		// Если вернулся 4xx код, значит хост существует, а URL указан некорректно. Можем сразу удалять такой
+		s.sub.remove(ctx, "status code 4xx received")
+		return nil
+	case deliveryRetryable:
+		// Хост недоступен или вернул 5xx, попробуем повторить отправку позже
+		sendQueue.PushAfter(s.retry(), s.retryAfter)
+		requeued = true
+		return nil
+	}
+	return
+}
+
+// send - Одна попытка доставки. Результат попытки записывается в историю доставки
+func (s *sendTask) send(ctx context.Context) (outcome deliveryOutcome, err error) {
+	defer func() { s.delivered = outcome == deliveryDelivered }()
+
+	if isSinkURL(s.sub.URL) {
+		return s.sendSink(ctx)
+	}
+
+	defer func() {
+		if err != nil {
+			s.lastErr = err.Error()
+		}
+	}()
+
 	var resp *http.Response
 	var req *http.Request
-	req, err = newRequest(s.sub, s.form)
+	req, err = newRequest(ctx, s)
 	if err != nil {
-		log.Printf(errorLog, err)
-		return
+		s.sub.hook.service.recordDelivery(ctx, s, 0, err, 0)
+		return deliveryFailed, err
 	}
 
-	resp, err = s.sub.hook.client.Do(req)
+	started := time.Now()
+	resp, err = s.sub.hook.clientFor(s.sub).Do(req)
 	if err != nil {
+		s.sub.hook.service.recordDelivery(ctx, s, 0, err, time.Since(started))
 		log.Printf("hook: error sending request, url='%s' error='%v'", s.sub.URL, err)
 
-		// Если это повторная отправка и вернулась ошибка - увеличиваем счетчик ошибок
-		if s.repeating {
-			s.sub.incErrCount()
-			return nil
-		}
-
 		// Это значит, что хост недоступен попробуем еще раз позже
 		if strings.Contains(err.Error(), "connection refused") {
-			sendQueue.Push(newSendTask(s.sub, s.form, true))
+			return deliveryRetryable, err
 		}
-		return
+		return deliveryFailed, err
+	}
+	body := s.sub.hook.readResponse(resp)
+	s.sub.hook.service.recordDelivery(ctx, s, resp.StatusCode, nil, time.Since(started))
+
+	// Токен OAuth2 мог быть отозван раньше срока, следующая отправка запросит новый
+	if resp.StatusCode == http.StatusUnauthorized {
+		s.sub.hook.service.tokens.invalidate(s.sub.Auth)
+	}
+
+	// Подписчик просит подождать: до истечения паузы ему не отправляются и другие события
+	s.retryAfter = 0
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if s.retryAfter = parseRetryAfter(resp); s.retryAfter > 0 {
+			s.sub.hook.service.limits.block(s.sub, s.retryAfter)
+		}
+	}
+
+	s.lastErr = fmt.Sprintf("unexpected status code %d", resp.StatusCode)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		s.throttled++
+		s.throttledN++
+		return deliveryThrottled, nil
 	}
+	s.throttled = 0
 
 	switch resp.StatusCode / 100 {
 	case 2:
-		// При положительном ответе сбрасываем счетчик ошибок обратно до 0
-		s.sub.resetErrCount()
+		s.lastErr = ""
+		return deliveryDelivered, nil
 	case 4:
-		// Если это повторная отправка и вернулся 4xx - увеличиваем счетчик ошибок
-		if s.repeating {
-			s.sub.incErrCount()
-			return nil
-		}
-
-		// Если вернулся 4xx код, значит хост существует, а URL указан некорректно. Можем сразу удалять такой
-		_, err = s.sub.hook.service.pg.Exec(sqlDeleteSub, s.sub.hook.name, s.sub.URL)
-		if err != nil {
-			log.Printf(hookErr, s.sub.hook.name, fmt.Sprintf("cannot delete subscription url='%s'", s.sub.URL))
-		}
-		log.Printf(hookWarning, s.sub.hook.name, fmt.Sprintf("subscription url='%s' deleted cause status code 4xx received", s.sub.URL))
+		return deliveryRejected, nil
 	case 5:
-		// Если это повторная отправка и вернулся 5xx - увеличиваем счетчик ошибок
-		if s.repeating {
-			s.sub.incErrCount()
-			return nil
-		}
+		return deliveryRetryable, nil
+	}
+
+	// Нестандартное поведение логируем
+	log.Printf("hook: error sending request, url='%s' error='unexpected status code %d' response='%s'", s.sub.URL, resp.StatusCode, truncate(string(body), maxLoggedBody))
+	return deliveryFailed, nil
+}
 
-		// Если вернулся 5xx код, то нужно это отметить в БД и попробовать повторить отправку позже
-		sendQueue.Push(newSendTask(s.sub, s.form, true))
-	default:
-		// Нестандартное поведение логируем
-		log.Printf("hook: error sending request, url='%s' error='unexpected status code %d'", s.sub.URL, resp.StatusCode)
+// setHeaders - Установка заголовков события или пачки
+func (s *sendTask) setHeaders(h http.Header) {
+	if s.batchID != "" {
+		setBatchHeaders(h, s)
+	} else {
+		s.events[0].setHeaders(h, s.attempt)
 	}
-	return
+
+	if s.seq != 0 {
+		h.Set(HeaderSequence, strconv.FormatInt(s.seq, 10))
+	}
+}
+
+// deadLetter - Сохранение событий, которые не удалось доставить подписчику в режиме HookOptions.Ordered
+func (s *sendTask) deadLetter(ctx context.Context) {
+	s.sub.hook.service.saveDeadLetter(ctx, s)
+}
+
+// throttleDelay - Пауза после ответа 429: Retry-After, если подписчик его прислал, иначе растущая пауза хука
+func (s *sendTask) throttleDelay() time.Duration {
+	if s.retryAfter > 0 {
+		return s.retryAfter
+	}
+	return s.sub.hook.opts.retryBackoff(s.throttled)
 }
@@ -0,0 +1,274 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/web"
+)
+
+// Время блокировки отписки после неверных pass_code, если не задано InboundLimits.LockoutDuration
+const defaultLockoutDuration = 15 * time.Minute
+
+// Имя внутреннего воркера, очищающего устаревшие счетчики защиты эндпоинтов подписки
+const inboundCleanupWorker = "hook_inbound_cleanup"
+
+// InboundLimits - Защита эндпоинтов /hook от злоупотреблений. Нулевые значения - без ограничений
+type InboundLimits struct {
+	PerIP             float64 // Запросов в секунду с одного IP
+	PerIPBurst        int     // Запросов подряд с одного IP. По умолчанию 1
+	TrustForwardedFor bool    // Брать IP клиента из X-Forwarded-For. Только если сервис стоит за доверенным прокси
+	TrustedProxyHops  int     // Сколько доверенных прокси перед сервисом дописывают адрес в X-Forwarded-For. По умолчанию 1
+
+	// Идентификатор клиента, например из заголовка авторизации. Пустая строка - запрос ограничивается только по IP
+	Principal         func(r *http.Request) string
+	PerPrincipal      float64 // Запросов в секунду от одного клиента
+	PerPrincipalBurst int     // Запросов подряд от одного клиента. По умолчанию 1
+
+	MaxSubsPerHook int // Подписок на один хук или шаблон
+	MaxSubsPerHost int // Подписок на URL одного хоста по всем хукам
+
+	MaxPassCodeFailures int           // Неверных pass_code и несуществующих подписок, после которых проверка pass_code блокируется для IP
+	LockoutDuration     time.Duration // Время блокировки. По умолчанию 15 минут
+}
+
+func (l *InboundLimits) validate() error {
+	if l.PerIP < 0 || l.PerPrincipal < 0 || math.IsNaN(l.PerIP) || math.IsNaN(l.PerPrincipal) ||
+		l.PerIPBurst < 0 || l.PerPrincipalBurst < 0 || l.MaxSubsPerHook < 0 || l.MaxSubsPerHost < 0 ||
+		l.MaxPassCodeFailures < 0 || l.LockoutDuration < 0 || l.TrustedProxyHops < 0 {
+		return fmt.Errorf("negative values are not allowed")
+	}
+
+	if l.PerPrincipal > 0 && l.Principal == nil {
+		return fmt.Errorf("PerPrincipal requires Principal")
+	}
+	return nil
+}
+
+func (l *InboundLimits) lockoutDuration() time.Duration {
+	if l.LockoutDuration == 0 {
+		return defaultLockoutDuration
+	}
+	return l.LockoutDuration
+}
+
+// clientIP - IP адрес клиента. Левые адреса X-Forwarded-For может подставить сам клиент, поэтому берется адрес,
+// который дописал самый дальний из TrustedProxyHops доверенных прокси
+func (l *InboundLimits) clientIP(r *http.Request) string {
+	if l.TrustForwardedFor {
+		var addrs []string
+		for _, h := range r.Header.Values("X-Forwarded-For") {
+			addrs = append(addrs, strings.Split(h, ",")...)
+		}
+
+		hops := l.TrustedProxyHops
+		if hops == 0 {
+			hops = 1
+		}
+		if i := len(addrs) - hops; len(addrs) > 0 {
+			if i < 0 {
+				i = 0
+			}
+			if addr := strings.TrimSpace(addrs[i]); addr != "" {
+				return addr
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// keyedLimiter - Ограничители частоты по произвольному ключу (IP, клиент)
+type keyedLimiter struct {
+	buckets map[string]*tokenBucket
+	sync.Mutex
+}
+
+func newKeyedLimiter() *keyedLimiter {
+	return &keyedLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+// allow - Взятие токена по ключу. Возвращает, сколько нужно подождать, если запрос сверх лимита
+func (l *keyedLimiter) allow(key string, limit float64, burst int) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	b := l.buckets[key]
+	if b == nil {
+		b = newTokenBucket(burst, now)
+		l.buckets[key] = b
+	}
+	return b.take(now, limit, burst)
+}
+
+// prune - Удаление ограничителей, которые не использовались дольше idle
+func (l *keyedLimiter) prune(idle time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	for key, b := range l.buckets {
+		if time.Since(b.last) > idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// passCodeFailures - Неверные pass_code по одному ключу
+type passCodeFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// passCodeGuard - Блокировка подбора pass_code по IP клиента. Блокировка по подписке позволила бы
+// любому заблокировать отписку владельцу, поэтому не используется
+type passCodeGuard struct {
+	failures map[string]*passCodeFailures
+	sync.Mutex
+}
+
+func newPassCodeGuard() *passCodeGuard {
+	return &passCodeGuard{failures: map[string]*passCodeFailures{}}
+}
+
+// locked - Сколько еще продлится блокировка по любому из ключей
+func (g *passCodeGuard) locked(keys ...string) (wait time.Duration) {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, key := range keys {
+		if f := g.failures[key]; f != nil {
+			if d := time.Until(f.lockedUntil); d > wait {
+				wait = d
+			}
+		}
+	}
+	return
+}
+
+// fail - Учет неверного pass_code. После max неверных попыток, между которыми прошло не больше lockout,
+// ключ блокируется на lockout. Успешные проверки счетчик не сбрасывают: иначе, имея свою подписку,
+// можно было бы чередовать ее проверку с подбором чужого pass_code и никогда не попасть под блокировку
+func (g *passCodeGuard) fail(max int, lockout time.Duration, keys ...string) {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		f := g.failures[key]
+		if f == nil {
+			f = &passCodeFailures{}
+			g.failures[key] = f
+		}
+		if now.Sub(f.last) > lockout {
+			f.count = 0
+		}
+		f.count++
+		f.last = now
+		if f.count >= max {
+			f.count = 0
+			f.lockedUntil = now.Add(lockout)
+			log.Printf(warningLog, fmt.Sprintf("hook: unsubscribe locked for '%s' cause too many invalid pass_code", key))
+		}
+	}
+}
+
+// prune - Удаление счетчиков без блокировки, которые не менялись дольше idle
+func (g *passCodeGuard) prune(idle time.Duration) {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	for key, f := range g.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.last) > idle {
+			delete(g.failures, key)
+		}
+	}
+}
+
+// inboundGuard - Состояние защиты эндпоинтов /hook, хранится в памяти экземпляра сервиса
+type inboundGuard struct {
+	limits    *InboundLimits
+	ip        *keyedLimiter
+	principal *keyedLimiter
+	passCodes *passCodeGuard
+}
+
+func newInboundGuard(limits *InboundLimits) *inboundGuard {
+	return &inboundGuard{
+		limits:    limits,
+		ip:        newKeyedLimiter(),
+		principal: newKeyedLimiter(),
+		passCodes: newPassCodeGuard(),
+	}
+}
+
+// middleware - Ограничение частоты запросов к /hook по IP и клиенту
+func (g *inboundGuard) middleware(w web.ResponseWriter, r *web.Request, next web.NextMiddlewareFunc) {
+	var wait time.Duration
+	if g.limits.PerIP > 0 {
+		wait = g.ip.allow(g.limits.clientIP(r.Request), g.limits.PerIP, g.limits.PerIPBurst)
+	}
+
+	if wait == 0 && g.limits.PerPrincipal > 0 {
+		if principal := g.limits.Principal(r.Request); principal != "" {
+			wait = g.principal.allow(principal, g.limits.PerPrincipal, g.limits.PerPrincipalBurst)
+		}
+	}
+
+	if wait > 0 {
+		sendTooManyRequests(w, wait, "too many requests")
+		return
+	}
+	next(w, r)
+}
+
+// passCodeLock - Ключи блокировки подбора pass_code и сколько еще продлится блокировка.
+// Для nil (Config.Inbound не задан) защита выключена
+func (g *inboundGuard) passCodeLock(r *http.Request) (keys []string, wait time.Duration) {
+	if g == nil || g.limits.MaxPassCodeFailures == 0 {
+		return nil, 0
+	}
+
+	keys = []string{"ip:" + g.limits.clientIP(r)}
+	return keys, g.passCodes.locked(keys...)
+}
+
+// passCodeChecked - Учет результата проверки pass_code по ключам из passCodeLock
+func (g *inboundGuard) passCodeChecked(keys []string, err error) {
+	if g == nil || len(keys) == 0 {
+		return
+	}
+
+	// Несуществующая подписка тоже считается неудачей, иначе по ответам можно перебирать подписки
+	if errors.Is(err, errInvalidPassCode) || errors.Is(err, errSubNotExists) {
+		g.passCodes.fail(g.limits.MaxPassCodeFailures, g.limits.lockoutDuration(), keys...)
+	}
+}
+
+// cleanup - Удаление счетчиков, которые уже ни на что не влияют
+func (g *inboundGuard) cleanup() error {
+	g.ip.prune(time.Hour)
+	g.principal.prune(time.Hour)
+	g.passCodes.prune(g.limits.lockoutDuration())
+	return nil
+}
+
+// sendTooManyRequests - Ответ 429 с заголовком Retry-After
+func sendTooManyRequests(w web.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	sendHookResponse(w, "", newHTTPError(http.StatusTooManyRequests, msg))
+}
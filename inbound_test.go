@@ -0,0 +1,111 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		trust      bool
+		hops       int
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "remote addr", remoteAddr: "10.0.0.1:5000", want: "10.0.0.1"},
+		{name: "remote addr without port", remoteAddr: "10.0.0.1", want: "10.0.0.1"},
+		{name: "forwarded ignored without trust", remoteAddr: "10.0.0.1:5000", forwarded: []string{"1.1.1.1"}, want: "10.0.0.1"},
+		{name: "single proxy", trust: true, remoteAddr: "10.0.0.1:5000", forwarded: []string{"1.1.1.1"}, want: "1.1.1.1"},
+		{name: "spoofed left entries", trust: true, remoteAddr: "10.0.0.1:5000", forwarded: []string{"6.6.6.6, 7.7.7.7, 1.1.1.1"}, want: "1.1.1.1"},
+		{name: "two proxies", trust: true, hops: 2, remoteAddr: "10.0.0.1:5000", forwarded: []string{"6.6.6.6, 1.1.1.1, 10.0.0.2"}, want: "1.1.1.1"},
+		{name: "several headers", trust: true, hops: 2, remoteAddr: "10.0.0.1:5000", forwarded: []string{"6.6.6.6, 1.1.1.1", "10.0.0.2"}, want: "1.1.1.1"},
+		{name: "fewer addresses than hops", trust: true, hops: 3, remoteAddr: "10.0.0.1:5000", forwarded: []string{"1.1.1.1, 10.0.0.2"}, want: "1.1.1.1"},
+		{name: "no header", trust: true, remoteAddr: "10.0.0.1:5000", want: "10.0.0.1"},
+		{name: "empty entry", trust: true, remoteAddr: "10.0.0.1:5000", forwarded: []string{"1.1.1.1, "}, want: "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &InboundLimits{TrustForwardedFor: tt.trust, TrustedProxyHops: tt.hops}
+			r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+			for _, h := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", h)
+			}
+			if got := l.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPassCodeLockout(t *testing.T) {
+	g := newInboundGuard(&InboundLimits{MaxPassCodeFailures: 3, LockoutDuration: time.Minute})
+	r := &http.Request{RemoteAddr: "10.0.0.1:5000", Header: http.Header{}}
+
+	keys, wait := g.passCodeLock(r)
+	if len(keys) != 1 || wait != 0 {
+		t.Fatalf("passCodeLock() = %v, %v", keys, wait)
+	}
+
+	// Верный pass_code между неудачами счетчик не сбрасывает, прочие ошибки не считаются
+	g.passCodeChecked(keys, errInvalidPassCode)
+	g.passCodeChecked(keys, nil)
+	g.passCodeChecked(keys, errors.New("database is down"))
+	g.passCodeChecked(keys, errSubNotExists)
+	if _, wait = g.passCodeLock(r); wait != 0 {
+		t.Fatalf("locked after 2 failures for %v", wait)
+	}
+
+	g.passCodeChecked(keys, errInvalidPassCode)
+	if _, wait = g.passCodeLock(r); wait <= 0 || wait > time.Minute {
+		t.Fatalf("lock after 3 failures = %v, want up to 1m", wait)
+	}
+
+	// Другой IP не заблокирован
+	other := &http.Request{RemoteAddr: "10.0.0.2:5000", Header: http.Header{}}
+	if _, wait = g.passCodeLock(other); wait != 0 {
+		t.Errorf("other ip locked for %v", wait)
+	}
+
+	// Блокировка истекает сама
+	g.passCodes.failures[keys[0]].lockedUntil = time.Now().Add(-time.Second)
+	if _, wait = g.passCodeLock(r); wait != 0 {
+		t.Errorf("lock did not expire: %v", wait)
+	}
+}
+
+func TestPassCodeFailuresWindow(t *testing.T) {
+	g := newPassCodeGuard()
+	const key = "ip:10.0.0.1"
+
+	g.fail(2, time.Minute, key)
+	// Неудача старше окна забывается, поэтому следующая считается первой
+	g.failures[key].last = time.Now().Add(-2 * time.Minute)
+	g.fail(2, time.Minute, key)
+	if wait := g.locked(key); wait != 0 {
+		t.Fatalf("locked after an expired failure for %v", wait)
+	}
+
+	g.fail(2, time.Minute, key)
+	if wait := g.locked(key); wait <= 0 {
+		t.Fatalf("not locked after 2 failures in the window")
+	}
+
+	// Счетчики без блокировки, не менявшиеся дольше idle, удаляются
+	g.failures[key].lockedUntil = time.Now().Add(-time.Second)
+	g.failures[key].last = time.Now().Add(-2 * time.Minute)
+	g.prune(time.Minute)
+	if len(g.failures) != 0 {
+		t.Errorf("prune left %d counters", len(g.failures))
+	}
+
+	var nilGuard *inboundGuard
+	if keys, wait := nilGuard.passCodeLock(&http.Request{}); keys != nil || wait != 0 {
+		t.Errorf("nil guard passCodeLock() = %v, %v", keys, wait)
+	}
+	nilGuard.passCodeChecked([]string{key}, errInvalidPassCode)
+}
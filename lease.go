@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/jackc/pgx/v5"
+)
+
+// Ограничения срока подписки (SubscribeOptions.Lease)
+const (
+	minSubscriptionLease = time.Minute
+	maxSubscriptionLease = 365 * 24 * time.Hour
+)
+
+// Предупреждение об истечении подписки приходит за 10% ее срока, но не раньше, чем за сутки
+// и не позже, чем за интервал воркера subscriptionReaperWorker: иначе подписка может истечь между его запусками
+const expiryWarningMax = 24 * time.Hour
+
+// Имя и интервал внутреннего воркера, предупреждающего об истечении подписок и удаляющего истекшие
+const (
+	subscriptionReaperWorker   = "hook_subscription_reaper"
+	subscriptionReaperInterval = time.Minute
+)
+
+// EventSubscriptionExpiring - Тип события, которое получает подписчик перед истечением срока подписки
+const EventSubscriptionExpiring = "subscription.expiring"
+
+func validateLease(lease time.Duration) error {
+	if lease != 0 && (lease < minSubscriptionLease || lease > maxSubscriptionLease) {
+		return fmt.Errorf("incorrect parameter lease, expected from %v to %v", minSubscriptionLease, maxSubscriptionLease)
+	}
+	return nil
+}
+
+// renew - Продление подписки на lease. Если lease = 0, то на срок, с которым подписка была создана или продлена
+func (h *hookPool) renew(ctx context.Context, name, url, passCode string, lease time.Duration) (expiresAt time.Time, err error) {
+	var id int64
+	if id, err = h.checkPassCode(ctx, name, url, passCode); err != nil {
+		return
+	}
+
+	if lease == 0 {
+		var seconds int
+		if err = h.parent.pg.QueryRow(ctx, h.parent.query(sqlSelectSubLease), id).Scan(&seconds); err != nil {
+			return
+		}
+		if seconds == 0 {
+			return expiresAt, fmt.Errorf(hookErr, name, "subscription has no lease, set lease_seconds")
+		}
+		lease = time.Duration(seconds) * time.Second
+	}
+
+	if err = validateLease(lease); err != nil {
+		return expiresAt, fmt.Errorf(hookErr, name, err.Error())
+	}
+
+	err = h.parent.pg.QueryRow(ctx, h.parent.query(sqlRenewSub), id, int(lease/time.Second)).Scan(&expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = fmt.Errorf("subscription expired")
+	}
+	return
+}
+
+// hookFor - Хук для подписки на name. Для шаблона - любой подходящий хук
+func (h *hookPool) hookFor(name string) *hook {
+	h.Lock()
+	defer h.Unlock()
+	if !isTopicPattern(name) {
+		return h.hooks[name]
+	}
+	for hookName, hk := range h.hooks {
+		if matchTopic(name, hookName) {
+			return hk
+		}
+	}
+	return nil
+}
+
+// reapSubscriptions - Предупреждение подписчиков, срок подписки которых скоро истечет, и удаление истекших подписок
+func (s *Service) reapSubscriptions() (err error) {
+	if err = s.warnExpiringSubs(s.ctx); err != nil {
+		return
+	}
+
+	var rows pgx.Rows
+	if rows, err = s.pg.Query(s.ctx, s.query(sqlDeleteExpiredSubs)); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, url string
+		var authSecret []byte
+		if err = rows.Scan(&name, &url, &authSecret); err != nil {
+			return
+		}
+		if auth, authErr := s.decryptAuth(authSecret); authErr == nil {
+			s.tokens.invalidate(auth)
+		}
+		log.Printf(hookWarning, name, fmt.Sprintf("subscription url='%s' deleted cause lease expired", redactURL(url)))
+	}
+	return rows.Err()
+}
+
+// warnExpiringSubs - Отправка события EventSubscriptionExpiring. Подписка помечается до отправки,
+// поэтому каждый подписчик получает предупреждение один раз за срок, даже если запущено несколько экземпляров сервиса.
+// Если предупреждение не удалось отправить или доставить, то метка снимается, и оно будет отправлено
+// при следующем запуске воркера
+func (s *Service) warnExpiringSubs(ctx context.Context) (err error) {
+	type expiring struct {
+		id        int64
+		name      string
+		expiresAt time.Time
+	}
+
+	var rows pgx.Rows
+	if rows, err = s.pg.Query(ctx, s.query(sqlMarkExpiringSubs), expiryWarningMax.Milliseconds(), subscriptionReaperInterval.Milliseconds()); err != nil {
+		return
+	}
+
+	var list []expiring
+	for rows.Next() {
+		var e expiring
+		if err = rows.Scan(&e.id, &e.name, &e.expiresAt); err != nil {
+			rows.Close()
+			return
+		}
+		list = append(list, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	var unsent []int64
+	defer func() {
+		if len(unsent) > 0 {
+			s.unmarkExpiring(unsent...)
+		}
+	}()
+
+	for i, e := range list {
+		// Хука может не быть в этом экземпляре сервиса, тогда предупреждение отправит другой
+		h := s.hPool.hookFor(e.name)
+		if h == nil {
+			unsent = append(unsent, e.id)
+			continue
+		}
+
+		var sub *Subscriber
+		if sub, err = h.loadSub(ctx, e.id); err != nil {
+			for _, rest := range list[i:] {
+				unsent = append(unsent, rest.id)
+			}
+			return
+		}
+		if sub == nil {
+			continue
+		}
+
+		// Метку при ошибке снимает сама отправка
+		if err = h.warnExpiring(ctx, sub, e.name, e.expiresAt); err != nil {
+			log.Printf(hookErr, h.name, fmt.Sprintf("cannot send expiry warning to url='%s': %v", sub.URL, err))
+			err = nil
+		}
+	}
+	return
+}
+
+// warnExpiring - Отправка подписчику события об истечении подписки. Типы событий и фильтр подписки не проверяются,
+// а режимы Ordered и Batch хука соблюдаются, как для обычных событий. Если доставка не удалась или событие
+// перенесено в dead letters, то метка expiry_warned снимается
+func (h *hook) warnExpiring(ctx context.Context, sub *Subscriber, name string, expiresAt time.Time) (err error) {
+	form := NewForm()
+	form.SetEvent(EventSubscriptionExpiring)
+	form.Add("subscription", name)
+	form.Add("url", sub.URL)
+	form.Add("expires_at", expiresAt.UTC().Format(time.RFC3339))
+
+	ev := newEvent(h.name, form)
+	ev.tracker = newDeliveryTracker(func(failed bool) {
+		if failed {
+			h.service.unmarkExpiring(sub.ID)
+		}
+	})
+	defer func() {
+		if err != nil {
+			ev.tracker.fail()
+		}
+		ev.tracker.release(true)
+	}()
+
+	if err = h.service.saveEvent(ctx, ev); err != nil {
+		return
+	}
+	return h.deliver(ctx, []recipient{{sub: sub, ev: ev}})
+}
+
+// unmarkExpiring - Снятие метки expiry_warned, чтобы предупреждение отправилось еще раз
+func (s *Service) unmarkExpiring(ids ...int64) {
+	if _, err := s.pg.Exec(context.Background(), s.query(sqlUnmarkExpiringSubs), ids); err != nil {
+		log.Printf(serviceErr, s.name, fmt.Sprintf("cannot unmark %d expiring subscriptions: %v", len(ids), err))
+	}
+}
+
+// renewHandler - Продление подписки: url, pass_code, lease_seconds (по умолчанию - прежний срок подписки)
+func (h *hookCtx) renewHandler(w web.ResponseWriter, r *web.Request) {
+	var err error
+	err = r.ParseMultipartForm(maxMultipartMemory)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while parsing form-data: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	name := r.PathParams["name"]
+	url := r.PostFormValue("url")
+	passCode := r.PostFormValue("pass_code")
+
+	var lease time.Duration
+	if v := r.PostFormValue("lease_seconds"); v != "" {
+		var seconds int
+		if seconds, err = strconv.Atoi(v); err != nil || seconds <= 0 {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter lease_seconds"))
+			return
+		}
+		lease = time.Duration(seconds) * time.Second
+	}
+
+	keys, locked := h.passCodeLocked(w, r)
+	if locked {
+		return
+	}
+
+	var expiresAt time.Time
+	expiresAt, err = h.s.RenewSubscription(r.Context(), name, url, passCode, lease)
+	h.s.inbound.passCodeChecked(keys, err)
+	if err != nil {
+		sendHookResponse(w, "", err)
+		return
+	}
+
+	if sendJSON(w, http.StatusOK, hookResponse{Success: true, ExpiresAt: expiresAt.UTC().Format(time.RFC3339)}) {
+		log.Printf("hook: subscription renewed args:(hook='%s', url='%s', expires_at='%s')", name, redactURL(url), expiresAt.Format(time.RFC3339))
+	}
+}
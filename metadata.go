@@ -0,0 +1,61 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+)
+
+// Ограничения описательных полей подписки
+const (
+	maxDescriptionLen = 1024
+	maxLabels         = 32
+	maxMetadataBytes  = 16 * 1024
+)
+
+// validateMetadata - Проверка описания, контакта, меток и метаданных подписки
+func (o *SubscribeOptions) validateMetadata() (err error) {
+	if len([]rune(o.Description)) > maxDescriptionLen {
+		return fmt.Errorf("description is longer than %d characters", maxDescriptionLen)
+	}
+
+	if o.ContactEmail != "" {
+		var addr *mail.Address
+		if addr, err = mail.ParseAddress(o.ContactEmail); err != nil || addr.Address != o.ContactEmail {
+			return fmt.Errorf("incorrect contact_email='%s'", o.ContactEmail)
+		}
+	}
+
+	if len(o.Labels) > maxLabels {
+		return fmt.Errorf("more than %d labels", maxLabels)
+	}
+	for _, l := range o.Labels {
+		if !validLabel(l) {
+			return fmt.Errorf("incorrect label='%s'", l)
+		}
+	}
+
+	if o.Metadata != nil {
+		var data []byte
+		if data, err = json.Marshal(o.Metadata); err != nil {
+			return fmt.Errorf("incorrect metadata: %v", err)
+		}
+		if len(data) > maxMetadataBytes {
+			return fmt.Errorf("metadata is larger than %d bytes", maxMetadataBytes)
+		}
+	}
+	return nil
+}
+
+// metaString - Значение метаданных в виде строки: строки как есть, остальное - JSON, отсутствующее - пустая строка
+func metaString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
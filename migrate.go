@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+const migrateErr = "migrate: version=%d name='%s' error='%v'"
+
+// migration - одна версия схемы веб-хуков. Файлы лежат в migrations/ и называются NNNN_description.sql
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations - Чтение встроенных миграций, отсортированных по возрастанию версии
+func loadMigrations() (list []migration, err error) {
+	var files []string
+	if files, err = fs.Glob(migrationsFS, "migrations/*.sql"); err != nil {
+		return nil, err
+	}
+
+	seen := map[int]string{}
+	for _, file := range files {
+		base := strings.TrimSuffix(path.Base(file), ".sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migrate: invalid file name '%s'", file)
+		}
+
+		var version int
+		if version, err = strconv.Atoi(parts[0]); err != nil || version <= 0 {
+			return nil, fmt.Errorf("migrate: invalid version in file name '%s'", file)
+		}
+
+		if seen[version] != "" {
+			return nil, fmt.Errorf("migrate: duplicate version %d in '%s' and '%s'", version, seen[version], file)
+		}
+		seen[version] = file
+
+		var data []byte
+		if data, err = migrationsFS.ReadFile(file); err != nil {
+			return nil, err
+		}
+
+		list = append(list, migration{version: version, name: parts[1], sql: string(data)})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].version < list[j].version })
+	return
+}
+
+// Migrate - Применение недостающих миграций схемы веб-хуков (см. Config.DBSchema).
+// Выполняется под advisory lock, поэтому несколько реплик сервиса могут вызывать его одновременно
+func (s *Service) Migrate(ctx context.Context) (err error) {
+	if err = s.connectDB(ctx); err != nil {
+		return fmt.Errorf(serviceErr, s.name, err)
+	}
+	return s.migrate(ctx, nil)
+}
+
+// MigrateDryRun - Вывод в w SQL миграций, которые будут применены при вызове Migrate. БД не изменяется
+func (s *Service) MigrateDryRun(ctx context.Context, w io.Writer) (err error) {
+	if err = s.connectDB(ctx); err != nil {
+		return fmt.Errorf(serviceErr, s.name, err)
+	}
+	return s.migrate(ctx, w)
+}
+
+// migrate - Если dryRun != nil, то вместо применения миграций их SQL пишется в dryRun
+func (s *Service) migrate(ctx context.Context, dryRun io.Writer) (err error) {
+	var list []migration
+	if list, err = loadMigrations(); err != nil {
+		return
+	}
+
+	var conn *pgxpool.Conn
+	if conn, err = s.pg.Acquire(ctx); err != nil {
+		return
+	}
+	defer conn.Release()
+
+	// Блокировка держится на уровне сессии, поэтому все запросы ниже выполняются в одном соединении
+	if _, err = conn.Exec(ctx, s.query(sqlMigrationLock), s.query(migrationLockKey)); err != nil {
+		return
+	}
+	defer func() {
+		if _, unlockErr := conn.Exec(context.Background(), s.query(sqlMigrationUnlock), s.query(migrationLockKey)); unlockErr != nil {
+			log.Printf(warningLog, fmt.Sprintf("migrate: cannot release advisory lock: %v", unlockErr))
+		}
+	}()
+
+	var applied map[int]bool
+	if applied, err = s.appliedMigrations(ctx, conn, dryRun == nil); err != nil {
+		return
+	}
+
+	known := map[int]bool{}
+	for _, m := range list {
+		known[m.version] = true
+	}
+	for v := range applied {
+		if !known[v] {
+			log.Printf(warningLog, fmt.Sprintf("migrate: database has unknown version %d, binary is probably outdated", v))
+		}
+	}
+
+	for _, m := range list {
+		if applied[m.version] {
+			continue
+		}
+
+		if dryRun != nil {
+			if _, err = fmt.Fprintf(dryRun, "-- migration %04d_%s\n%s\n\n", m.version, m.name, strings.TrimSpace(s.query(m.sql))); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err = s.applyMigration(ctx, conn, m); err != nil {
+			return fmt.Errorf(migrateErr, m.version, m.name, err)
+		}
+		log.Printf("migrate: version=%d name='%s' has been applied\n", m.version, m.name)
+	}
+	return
+}
+
+// appliedMigrations - Список уже примененных версий. При create == false таблица schema_migrations не создается
+func (s *Service) appliedMigrations(ctx context.Context, conn *pgxpool.Conn, create bool) (applied map[int]bool, err error) {
+	applied = map[int]bool{}
+
+	if create {
+		if _, err = conn.Exec(ctx, s.query(createMigrationsTable)); err != nil {
+			return nil, err
+		}
+	} else {
+		var exists bool
+		if err = conn.QueryRow(ctx, s.query(sqlMigrationsTableExists)).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return
+		}
+	}
+
+	var rows pgx.Rows
+	if rows, err = conn.Query(ctx, s.query(sqlSelectMigrations)); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v int32
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[int(v)] = true
+	}
+	return applied, rows.Err()
+}
+
+func (s *Service) applyMigration(ctx context.Context, conn *pgxpool.Conn, m migration) (err error) {
+	var tx pgx.Tx
+	if tx, err = conn.Begin(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(context.Background())
+		}
+	}()
+
+	if _, err = tx.Exec(ctx, s.query(m.sql)); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(ctx, s.query(sqlInsertMigration), int32(m.version), m.name); err != nil {
+		return
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,23 @@
+create schema if not exists {schema};
+
+create table if not exists {schema}.{prefix}hooks
+(
+    Name Name not null
+        constraint {prefix}hooks_pk
+            primary key,
+    function_name name
+);
+
+create table if not exists {schema}.{prefix}subscribers
+(
+    hook_name Name
+        constraint {prefix}subscribers_hooks_name_fk
+            references {schema}.{prefix}hooks
+            on update cascade on delete cascade,
+    url       text              not null,
+    pass_code uuid              not null,
+    err_count integer default 0 not null
+);
+
+create unique index if not exists {prefix}subscribers_hook_name_url_uindex
+    on {schema}.{prefix}subscribers (hook_name, url);
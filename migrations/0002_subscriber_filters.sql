@@ -0,0 +1,3 @@
+alter table {schema}.{prefix}subscribers
+    add column if not exists event_types text[] default '{}' not null,
+    add column if not exists filter      text   default ''   not null;
@@ -0,0 +1,13 @@
+alter table {schema}.{prefix}subscribers
+    add column if not exists id      bigserial not null,
+    add column if not exists pattern text;
+
+alter table {schema}.{prefix}subscribers
+    add constraint {prefix}subscribers_pk
+        primary key (id),
+    add constraint {prefix}subscribers_hook_or_pattern_check
+        check ((hook_name is null) <> (pattern is null));
+
+create unique index if not exists {prefix}subscribers_pattern_url_uindex
+    on {schema}.{prefix}subscribers (pattern, url)
+    where pattern is not null;
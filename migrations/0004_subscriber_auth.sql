@@ -0,0 +1,4 @@
+alter table {schema}.{prefix}subscribers
+    add column if not exists headers     jsonb default '{}' not null,
+    add column if not exists auth_type   text  default ''   not null,
+    add column if not exists auth_secret bytea;
@@ -0,0 +1,2 @@
+alter table {schema}.{prefix}subscribers
+    add column if not exists tls_secret bytea;
@@ -0,0 +1,34 @@
+create table if not exists {schema}.{prefix}events
+(
+    id         uuid        not null
+        constraint {prefix}events_pk
+            primary key,
+    hook_name  name        not null,
+    event_type text        not null,
+    payload    jsonb       not null,
+    created_at timestamptz not null
+);
+
+create index if not exists {prefix}events_created_at_index
+    on {schema}.{prefix}events (created_at);
+
+create table if not exists {schema}.{prefix}deliveries
+(
+    id            bigserial                 not null
+        constraint {prefix}deliveries_pk
+            primary key,
+    event_id      uuid                      not null
+        constraint {prefix}deliveries_events_id_fk
+            references {schema}.{prefix}events
+            on delete cascade,
+    subscriber_id bigint                    not null,
+    url           text                      not null,
+    attempt       integer                   not null,
+    status_code   integer,
+    error         text    default ''        not null,
+    duration_ms   bigint                    not null,
+    created_at    timestamptz default now() not null
+);
+
+create index if not exists {prefix}deliveries_event_id_index
+    on {schema}.{prefix}deliveries (event_id);
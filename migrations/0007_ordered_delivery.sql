@@ -0,0 +1,23 @@
+alter table {schema}.{prefix}subscribers
+    add column if not exists seq bigint default 0 not null;
+
+create table if not exists {schema}.{prefix}dead_letters
+(
+    id            bigserial                 not null
+        constraint {prefix}dead_letters_pk
+            primary key,
+    event_id      uuid                      not null
+        constraint {prefix}dead_letters_events_id_fk
+            references {schema}.{prefix}events
+            on delete cascade,
+    subscriber_id bigint                    not null,
+    hook_name     name                      not null,
+    url           text                      not null,
+    seq           bigint,
+    attempts      integer                   not null,
+    error         text    default ''        not null,
+    created_at    timestamptz default now() not null
+);
+
+create index if not exists {prefix}dead_letters_subscriber_id_index
+    on {schema}.{prefix}dead_letters (subscriber_id);
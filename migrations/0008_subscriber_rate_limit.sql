@@ -0,0 +1,3 @@
+alter table {schema}.{prefix}subscribers
+    add column if not exists rate_limit double precision default 0 not null,
+    add column if not exists rate_burst integer          default 0 not null;
@@ -0,0 +1,9 @@
+alter table {schema}.{prefix}subscribers
+    add column if not exists host text default '' not null;
+
+update {schema}.{prefix}subscribers
+set host = lower(coalesce(substring(url from '^[^:]+://(?:[^/@]*@)?([^/:?#]+)'), ''))
+where host = '';
+
+create index if not exists {prefix}subscribers_host_index
+    on {schema}.{prefix}subscribers (host);
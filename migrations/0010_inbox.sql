@@ -0,0 +1,18 @@
+create table if not exists {schema}.{prefix}inbox
+(
+    id            bigserial                 not null
+        constraint {prefix}inbox_pk
+            primary key,
+    subscriber_id bigint                    not null
+        constraint {prefix}inbox_subscribers_id_fk
+            references {schema}.{prefix}subscribers
+            on delete cascade,
+    event_id      uuid                      not null
+        constraint {prefix}inbox_events_id_fk
+            references {schema}.{prefix}events
+            on delete cascade,
+    created_at    timestamptz default now() not null
+);
+
+create index if not exists {prefix}inbox_subscriber_id_index
+    on {schema}.{prefix}inbox (subscriber_id, id);
@@ -0,0 +1,6 @@
+alter table {schema}.{prefix}inbox
+    add column if not exists acked_at timestamptz;
+
+create index if not exists {prefix}inbox_unacked_index
+    on {schema}.{prefix}inbox (subscriber_id, id)
+    where acked_at is null;
@@ -0,0 +1,4 @@
+alter table {schema}.{prefix}inbox
+    add column if not exists leased_until timestamptz,
+    add column if not exists lease_id     uuid,
+    add column if not exists deliveries   integer default 0 not null;
@@ -0,0 +1,28 @@
+-- Функция для триггеров на таблицах пользователя (Service.InstallTableTrigger).
+-- TG_ARGV[0] - имя хука, TG_ARGV[1] - канал NOTIFY (Config.NotifyChannel).
+-- Размер сообщения NOTIFY ограничен 8000 байт, поэтому слишком большая строка заменяется признаком truncated
+create or replace function {schema}.{prefix}notify_hook() returns trigger
+    language plpgsql
+as
+$$
+declare
+    row_data jsonb;
+    message  text;
+begin
+    if TG_OP = 'DELETE' then
+        row_data = to_jsonb(OLD);
+    else
+        row_data = to_jsonb(NEW);
+    end if;
+
+    message = jsonb_build_object('hook', TG_ARGV[0], 'event', TG_ARGV[0] || '.' || lower(TG_OP),
+                                 'table', TG_TABLE_SCHEMA || '.' || TG_TABLE_NAME, 'payload', row_data)::text;
+    if octet_length(message) > 7900 then
+        message = jsonb_build_object('hook', TG_ARGV[0], 'event', TG_ARGV[0] || '.' || lower(TG_OP),
+                                     'table', TG_TABLE_SCHEMA || '.' || TG_TABLE_NAME, 'truncated', true)::text;
+    end if;
+
+    perform pg_notify(TG_ARGV[1], message);
+    return null;
+end;
+$$;
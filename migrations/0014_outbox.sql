@@ -0,0 +1,13 @@
+create table if not exists {schema}.{prefix}outbox
+(
+    id         uuid                      not null
+        constraint {prefix}outbox_pk
+            primary key,
+    hook_name  name                      not null,
+    event_type text    default ''        not null,
+    payload    jsonb                     not null,
+    created_at timestamptz default now() not null
+);
+
+create index if not exists {prefix}outbox_created_at_index
+    on {schema}.{prefix}outbox (created_at);
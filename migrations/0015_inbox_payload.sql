@@ -0,0 +1,4 @@
+-- Тип и данные события, если они у подписчика свои (HookFuncMap.AddPerSubscriber). Иначе берутся из events
+alter table {schema}.{prefix}inbox
+    add column if not exists event_type text,
+    add column if not exists payload    jsonb;
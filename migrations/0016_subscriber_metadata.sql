@@ -0,0 +1,9 @@
+alter table {schema}.{prefix}subscribers
+    add column if not exists description   text        default ''    not null,
+    add column if not exists contact_email text        default ''    not null,
+    add column if not exists labels        text[]      default '{}'  not null,
+    add column if not exists metadata      jsonb       default '{}'  not null,
+    add column if not exists created_at    timestamptz default now() not null;
+
+create index if not exists {prefix}subscribers_labels_index
+    on {schema}.{prefix}subscribers using gin (labels);
@@ -0,0 +1,8 @@
+alter table {schema}.{prefix}subscribers
+    add column if not exists lease_seconds integer     default 0     not null,
+    add column if not exists expires_at    timestamptz,
+    add column if not exists expiry_warned boolean     default false not null;
+
+create index if not exists {prefix}subscribers_expires_at_index
+    on {schema}.{prefix}subscribers (expires_at)
+    where expires_at is not null;
@@ -0,0 +1,11 @@
+-- pass_code хранится в виде соленого хеша (см. passcode.go), поэтому тип меняется на text.
+-- Старые значения остаются как есть и проверяются, пока не будут преобразованы
+alter table {schema}.{prefix}subscribers
+    alter column pass_code type text using pass_code::text;
+
+alter table {schema}.{prefix}subscribers
+    add column if not exists pass_code_prev            text,
+    add column if not exists pass_code_prev_until      timestamptz,
+    add column if not exists signing_secret            bytea,
+    add column if not exists signing_secret_prev       bytea,
+    add column if not exists signing_secret_prev_until timestamptz;
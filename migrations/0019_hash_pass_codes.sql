@@ -0,0 +1,19 @@
+-- Преобразование pass_code, сохраненных до хеширования, в соленые хеши того же формата, что в passcode.go:
+-- s1$<соль hex>$<sha256(соль + pass_code) hex>
+update {schema}.{prefix}subscribers s
+set pass_code = 's1$' || x.salt || '$' || encode(sha256(decode(x.salt, 'hex') || convert_to(s.pass_code, 'UTF8')), 'hex')
+from (select id, md5(random()::text || clock_timestamp()::text || id::text) as salt
+      from {schema}.{prefix}subscribers
+      where pass_code not like 's1$%') x
+where s.id = x.id;
+
+update {schema}.{prefix}subscribers s
+set pass_code_prev = 's1$' || x.salt || '$' || encode(sha256(decode(x.salt, 'hex') || convert_to(s.pass_code_prev, 'UTF8')), 'hex')
+from (select id, md5(random()::text || clock_timestamp()::text || id::text) as salt
+      from {schema}.{prefix}subscribers
+      where pass_code_prev not like 's1$%') x
+where s.id = x.id;
+
+alter table {schema}.{prefix}subscribers
+    add constraint {prefix}subscribers_pass_code_hashed_check
+        check (pass_code like 's1$%' and (pass_code_prev is null or pass_code_prev like 's1$%'));
@@ -0,0 +1,9 @@
+-- Начало шаблона до первого '*' или '#' вместе с точкой: "order.payment." для order.payment.*, "" для #.*.
+-- Подходящие под хук шаблоны ищутся по индексу среди тех, чье начало - один из префиксов имени хука
+alter table {schema}.{prefix}subscribers
+    add column if not exists pattern_prefix text
+        generated always as (substring(pattern from '^((?:[^.*#]+\.)*)')) stored;
+
+create index if not exists {prefix}subscribers_pattern_prefix_index
+    on {schema}.{prefix}subscribers (pattern_prefix)
+    where pattern is not null;
@@ -0,0 +1,4 @@
+-- Дополнительные заголовки подписок могут содержать ключи API, поэтому хранятся зашифрованными так же, как
+-- авторизация и TLS. Заголовки, сохраненные открыто, шифруются при старте сервиса с Config.SecretKey
+alter table {schema}.{prefix}subscribers
+    add column if not exists headers_secret bytea;
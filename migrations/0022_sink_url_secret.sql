@@ -0,0 +1,4 @@
+-- URL подписок на брокеры содержат учетные данные, поэтому полный URL хранится зашифрованным,
+-- а в колонке url учетные данные заменены отпечатком. URL, сохраненные открыто, шифруются при старте сервиса
+alter table {schema}.{prefix}subscribers
+    add column if not exists url_secret bytea;
@@ -0,0 +1,4 @@
+-- Событие outbox остается в таблице, пока его доставка не завершится. dispatched_at - время постановки в очередь
+-- отправки, такие строки повторно отправляются только после outboxInFlightTimeout (экземпляр сервиса упал)
+alter table {schema}.{prefix}outbox
+    add column if not exists dispatched_at timestamptz;
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Задержки переподключения к каналу NOTIFY после обрыва соединения
+const (
+	notifyReconnectMin = time.Second
+	notifyReconnectMax = time.Minute
+	notifyLockRetry    = 5 * time.Second // Как часто экземпляр без блокировки пробует стать слушателем
+)
+
+// Операции таблицы, на которые можно поставить триггер хука
+var tableTriggerOps = map[string]bool{"insert": true, "update": true, "delete": true}
+
+// notifyMessage - Сообщение в канале Config.NotifyChannel, по которому вызывается хук:
+// {"hook": "orders", "event": "orders.insert", "payload": {"id": 1, "status": "new"}}
+type notifyMessage struct {
+	Hook      string                     `json:"hook"`
+	Event     string                     `json:"event"`
+	Table     string                     `json:"table"`
+	Payload   map[string]json.RawMessage `json:"payload"`
+	Truncated bool                       `json:"truncated"`
+}
+
+func (m *notifyMessage) form() *Form {
+	form := formFromJSON(m.Event, m.Payload)
+	// У обрезанного сообщения нет payload, поэтому признак не пересекается с колонками строки
+	if m.Truncated {
+		form.Add("truncated", "true")
+	}
+	return form
+}
+
+// listenNotify - Прослушивание канала Config.NotifyChannel до остановки сервиса. При обрыве соединения переподключается.
+// Канал слушает только один экземпляр сервиса - тот, что держит advisory lock канала, остальные ждут его освобождения.
+// Сообщения, отправленные, пока никто не слушает канал (переподключение или смена слушателя), теряются
+func (s *Service) listenNotify() {
+	delay := notifyReconnectMin
+	for {
+		err := s.listenNotifyConn(s.ctx, func() { delay = notifyReconnectMin })
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		log.Printf(serviceErr, s.name, fmt.Sprintf("notify channel '%s' lost, reconnect in %v: %v", s.cfg.NotifyChannel, delay, err))
+		if !sleepCtx(s.ctx, delay) {
+			return
+		}
+		if delay *= 2; delay > notifyReconnectMax {
+			delay = notifyReconnectMax
+		}
+	}
+}
+
+// listenNotifyConn - Одно подключение к каналу. Для LISTEN открывается отдельное соединение,
+// чтобы не занимать коннект пула на все время работы сервиса
+func (s *Service) listenNotifyConn(ctx context.Context, onListen func()) (err error) {
+	var conn *pgx.Conn
+	if conn, err = pgx.ConnectConfig(ctx, s.pg.Config().ConnConfig.Copy()); err != nil {
+		return
+	}
+	defer func() { _ = conn.Close(context.Background()) }()
+
+	// Блокировка держится на уровне сессии и снимается вместе с закрытием соединения
+	if err = s.lockNotify(ctx, conn); err != nil {
+		return
+	}
+
+	if _, err = conn.Exec(ctx, "listen "+pgx.Identifier{s.cfg.NotifyChannel}.Sanitize()); err != nil {
+		return
+	}
+	onListen()
+
+	for {
+		var n *pgconn.Notification
+		if n, err = conn.WaitForNotification(ctx); err != nil {
+			return
+		}
+		s.handleNotify(n.Payload)
+	}
+}
+
+// lockNotify - Ожидание advisory lock канала, чтобы хук по одному сообщению вызвал только один экземпляр сервиса
+func (s *Service) lockNotify(ctx context.Context, conn *pgx.Conn) (err error) {
+	key := s.query(notifyLockKey) + s.cfg.NotifyChannel
+	for {
+		var locked bool
+		if err = conn.QueryRow(ctx, s.query(sqlNotifyTryLock), key).Scan(&locked); err != nil || locked {
+			return
+		}
+		if !sleepCtx(ctx, notifyLockRetry) {
+			return ctx.Err()
+		}
+	}
+}
+
+// handleNotify - Вызов хука по сообщению из канала. Ошибки только логируются, чтобы не останавливать прослушивание
+func (s *Service) handleNotify(payload string) {
+	var m notifyMessage
+	if err := json.Unmarshal([]byte(payload), &m); err != nil {
+		log.Printf(serviceErr, s.name, fmt.Sprintf("invalid notify payload='%s': %v", truncate(payload, 200), err))
+		return
+	}
+
+	if !validHookName(m.Hook) {
+		log.Printf(serviceErr, s.name, fmt.Sprintf("invalid hook name in notify payload='%s'", truncate(payload, 200)))
+		return
+	}
+
+	if m.Truncated {
+		log.Printf(hookWarning, m.Hook, fmt.Sprintf("notify payload of table '%s' exceeded NOTIFY limit and was truncated", m.Table))
+	}
+
+	// Ошибка вызова уже залогирована пулом хуков
+	_, _ = s.TriggerHookForm(m.Hook, m.form())
+}
+
+// InstallTableTrigger - Установка триггера на таблицу table ("orders" или "shop.orders"), который после
+// операций ops ("insert", "update", "delete"; по умолчанию insert и update) отправляет строку в канал
+// Config.NotifyChannel и тем самым вызывает хук hookName с событием "<hookName>.<операция>".
+// Повторная установка заменяет триггер. Вызывается после Start или Migrate
+func (s *Service) InstallTableTrigger(ctx context.Context, table, hookName string, ops ...string) (err error) {
+	if err = s.checkTableTriggerArgs(table, hookName); err != nil {
+		return
+	}
+
+	if len(ops) == 0 {
+		ops = []string{"insert", "update"}
+	}
+	events := make([]string, len(ops))
+	for i := range ops {
+		if events[i] = strings.ToLower(ops[i]); !tableTriggerOps[events[i]] {
+			return fmt.Errorf(hookErr, hookName, fmt.Sprintf("incorrect trigger operation='%s'", ops[i]))
+		}
+	}
+
+	trigger, target := s.tableTriggerNames(table, hookName)
+	function := s.query("{schema}.{prefix}notify_hook")
+	query := fmt.Sprintf("drop trigger if exists %s on %s; create trigger %s after %s on %s for each row execute procedure %s(%s, %s);",
+		trigger, target, trigger, strings.Join(events, " or "), target, function,
+		quoteLiteral(hookName), quoteLiteral(s.cfg.NotifyChannel))
+
+	if _, err = s.pg.Exec(ctx, query); err != nil {
+		return fmt.Errorf(hookErr, hookName, fmt.Sprintf("cannot install trigger on table '%s': %v", table, err))
+	}
+	return
+}
+
+// DropTableTrigger - Удаление триггера, установленного InstallTableTrigger
+func (s *Service) DropTableTrigger(ctx context.Context, table, hookName string) (err error) {
+	if err = s.checkTableTriggerArgs(table, hookName); err != nil {
+		return
+	}
+
+	trigger, target := s.tableTriggerNames(table, hookName)
+	if _, err = s.pg.Exec(ctx, fmt.Sprintf("drop trigger if exists %s on %s;", trigger, target)); err != nil {
+		return fmt.Errorf(hookErr, hookName, fmt.Sprintf("cannot drop trigger on table '%s': %v", table, err))
+	}
+	return
+}
+
+func (s *Service) checkTableTriggerArgs(table, hookName string) (err error) {
+	if s.cfg.NotifyChannel == "" {
+		return fmt.Errorf(hookErr, hookName, "Config.NotifyChannel is not set")
+	}
+	if s.pg == nil {
+		return fmt.Errorf(hookErr, hookName, "database is not connected")
+	}
+	if !validHookName(hookName) {
+		return fmt.Errorf(hookErr, hookName, fmt.Sprintf("incorrect parameter name='%s'", hookName))
+	}
+	if table == "" || strings.Count(table, ".") > 1 {
+		return fmt.Errorf(hookErr, hookName, fmt.Sprintf("incorrect parameter table='%s'", table))
+	}
+	return
+}
+
+// tableTriggerNames - Экранированные имена триггера и таблицы
+func (s *Service) tableTriggerNames(table, hookName string) (trigger, target string) {
+	name := s.dbPrefix + "hook_" + hookName
+	if len(name) > maxIdentLen {
+		name = name[:maxIdentLen]
+	}
+	return pgx.Identifier{name}.Sanitize(), pgx.Identifier(strings.Split(table, ".")).Sanitize()
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// Значения по умолчанию для упорядоченной доставки
+const (
+	defaultOrderedMaxAttempts = 5
+	defaultRetryBackoff       = time.Second
+	maxRetryBackoff           = time.Minute
+)
+
+func (o *HookOptions) maxAttempts() int {
+	if o.MaxAttempts == 0 {
+		return defaultOrderedMaxAttempts
+	}
+	return o.MaxAttempts
+}
+
+// retryBackoff - Пауза после неудачной попытки attempt
+func (o *HookOptions) retryBackoff(attempt int) time.Duration {
+	backoff := o.RetryBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
+
+// orderedLane - Очередь отправок одному подписчику хука в режиме HookOptions.Ordered.
+// Следующее событие отправляется только после успешной доставки предыдущего или переноса его в dead letters.
+// Порядок гарантируется в пределах одного экземпляра сервиса
+type orderedLane struct {
+	tasks   []*sendTask
+	running bool // Запущена горутина, обрабатывающая очередь
+}
+
+// enqueueOrdered - Постановка отправки в очередь подписчика
+func (h *hook) enqueueOrdered(task *sendTask) {
+	h.Lock()
+	defer h.Unlock()
+
+	lane := h.lanes[task.sub.ID]
+	if lane == nil {
+		lane = &orderedLane{}
+		h.lanes[task.sub.ID] = lane
+	}
+	lane.tasks = append(lane.tasks, task)
+
+	if !lane.running {
+		lane.running = true
+		go h.runLane(task.sub.ID, lane)
+	}
+}
+
+// headOrdered - Первая отправка в очереди. Пустая очередь удаляется
+func (h *hook) headOrdered(id int64, lane *orderedLane) *sendTask {
+	h.Lock()
+	defer h.Unlock()
+
+	if len(lane.tasks) == 0 {
+		lane.running = false
+		delete(h.lanes, id)
+		return nil
+	}
+	return lane.tasks[0]
+}
+
+func (h *hook) popOrdered(lane *orderedLane) {
+	h.Lock()
+	defer h.Unlock()
+	lane.tasks = lane.tasks[1:]
+}
+
+// dropOrdered - Извлечение всех отправок очереди
+func (h *hook) dropOrdered(lane *orderedLane) (tasks []*sendTask) {
+	h.Lock()
+	defer h.Unlock()
+	tasks, lane.tasks = lane.tasks, nil
+	return
+}
+
+// laneResult - Чем закончилась доставка первого события очереди
+type laneResult int
+
+const (
+	laneDone    laneResult = iota // Событие доставлено или перенесено в dead letters, можно отправлять следующее
+	laneRemoved                   // Подписка удалена, доставлять оставшиеся события некому
+	laneStopped                   // Сервис остановлен, событие остается в очереди недоставленным
+)
+
+func (h *hook) runLane(id int64, lane *orderedLane) {
+	ctx := h.service.ctx
+	for task := h.headOrdered(id, lane); task != nil; task = h.headOrdered(id, lane) {
+		switch h.deliverOrdered(ctx, task) {
+		case laneDone:
+			h.popOrdered(lane)
+			task.finish()
+		case laneRemoved:
+			for _, t := range h.dropOrdered(lane) {
+				t.deadLetter(ctx)
+				t.finish()
+			}
+		case laneStopped:
+			h.stopLane(lane)
+			return
+		}
+	}
+}
+
+// stopLane - Остановка обработки очереди без извлечения отправок
+func (h *hook) stopLane(lane *orderedLane) {
+	h.Lock()
+	defer h.Unlock()
+	lane.running = false
+}
+
+// deliverOrdered - Доставка события с повторами, пока оно не будет доставлено или перенесено в dead letters
+func (h *hook) deliverOrdered(ctx context.Context, task *sendTask) laneResult {
+	for {
+		if ctx.Err() != nil {
+			return laneStopped
+		}
+
+		// Если превышен счетчик отправок у подписчика, то автоматически отписываем его (удаляем из БД)
+		if task.sub.ErrCount >= maxErrCount {
+			task.sub.incErrCount(ctx)
+			return laneRemoved
+		}
+
+		// Ограничение частоты: очередь подписчика просто ждет
+		if wait := h.service.limits.reserve(task.sub); wait > 0 {
+			if !sleepCtx(ctx, wait) {
+				return laneStopped
+			}
+			continue
+		}
+
+		outcome, _ := task.send(ctx)
+		delay := h.opts.retryBackoff(task.failures())
+		switch outcome {
+		case deliveryDelivered:
+			task.sub.resetErrCount(ctx)
+			return laneDone
+		case deliveryRejected:
+			// Как и без упорядочивания: 4xx на первую попытку означает, что URL указан некорректно
+			if !task.repeating() {
+				task.sub.remove(ctx, "status code 4xx received")
+				return laneRemoved
+			}
+		case deliveryThrottled:
+			// Ответы 429 ограничиваются отдельно и не считаются ошибками подписки
+			if task.throttled >= maxThrottledRetries {
+				task.deadLetter(ctx)
+				return laneDone
+			}
+			if !sleepCtx(ctx, task.throttleDelay()) {
+				return laneStopped
+			}
+			task.attempt++
+			continue
+		}
+
+		// Отправка, прерванная остановкой сервиса, не считается неудачной попыткой
+		if ctx.Err() != nil {
+			return laneStopped
+		}
+
+		if task.failures() >= h.opts.maxAttempts() {
+			task.deadLetter(ctx)
+			task.sub.incErrCount(ctx)
+			return laneDone
+		}
+
+		if task.retryAfter > delay {
+			delay = task.retryAfter
+		}
+		if !sleepCtx(ctx, delay) {
+			return laneStopped
+		}
+		task.attempt++
+	}
+}
+
+// sleepCtx - Пауза d. Возвращает false, если контекст отменен раньше
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Имя внутреннего воркера, отправляющего события из outbox
+const outboxWorker = "hook_outbox_dispatch"
+
+// Событий outbox, которые обрабатываются в одной транзакции
+const outboxBatchSize = 100
+
+// Через сколько событие outbox, поставленное в очередь, отправляется повторно, если его доставка так и не
+// завершилась (экземпляр сервиса, отправлявший его, упал)
+const outboxInFlightTimeout = time.Hour
+
+// TriggerHookTx - Вызов веб-хука в транзакции tx вызывающего кода. Событие записывается в outbox в этой транзакции:
+// после ее отката подписчики ничего не получат, после фиксации событие будет отправлено, даже если сервис
+// перезапустится. Отправка выполняется воркером не позже чем через секунду после фиксации.
+// Возвращает ID события, с которым его получат подписчики
+func (s *Service) TriggerHookTx(ctx context.Context, tx pgx.Tx, name string, form *Form) (eventID string, err error) {
+	if err = checkTriggerForm(name, form); err != nil {
+		return "", err
+	}
+
+	if !s.hPool.exists(name) {
+		return "", fmt.Errorf(hookErr, name, "this hook not exists")
+	}
+
+	ev := newEvent(name, form)
+	if _, err = tx.Exec(ctx, s.query(sqlInsertOutbox), ev.id, name, form.Event, form.Payload, ev.created); err != nil {
+		return "", fmt.Errorf(hookErr, name, err)
+	}
+	return ev.id, nil
+}
+
+// dispatchOutbox - Отправка зафиксированных событий outbox
+func (s *Service) dispatchOutbox() (err error) {
+	for {
+		var n int
+		if n, err = s.dispatchOutboxBatch(s.ctx); err != nil || n < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// dispatchOutboxBatch - Отправка пачки событий outbox. Строки блокируются (skip locked), поэтому несколько экземпляров
+// сервиса не отправят одно событие дважды. После постановки в очередь строка помечается отправляемой и удаляется,
+// только когда доставка завершится у всех подписчиков (доставлено, перенесено в dead letters или подписка удалена).
+// Если сервис упадет раньше, событие будет отправлено повторно с тем же ID через outboxInFlightTimeout.
+// События хуков, которых нет в этом экземпляре, остаются в outbox для других экземпляров
+func (s *Service) dispatchOutboxBatch(ctx context.Context) (n int, err error) {
+	var tx pgx.Tx
+	if tx, err = s.pg.Begin(ctx); err != nil {
+		return
+	}
+
+	// Воркер держит записи поставленных в очередь событий до конца транзакции: строку, заблокированную ею,
+	// нельзя удалить, даже если доставка завершится раньше
+	var dispatched []*deliveryTracker
+	defer func() {
+		_ = tx.Rollback(context.Background())
+		for _, t := range dispatched {
+			t.release(true)
+		}
+	}()
+
+	var rows pgx.Rows
+	if rows, err = tx.Query(ctx, s.query(sqlSelectOutbox), outboxBatchSize, s.hPool.names(), outboxInFlightTimeout.Milliseconds()); err != nil {
+		return
+	}
+
+	var events []*event
+	for rows.Next() {
+		ev := &event{form: NewForm()}
+		if err = rows.Scan(&ev.id, &ev.hook, &ev.form.Event, &ev.form.Payload, &ev.created); err != nil {
+			rows.Close()
+			return
+		}
+		events = append(events, ev)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	blocked := map[string]bool{}
+	for _, ev := range events {
+		// Событие и следующие за ним события того же хука остаются в outbox до следующего запуска воркера,
+		// чтобы не нарушать порядок. События остальных хуков отправляются
+		if blocked[ev.hook] {
+			continue
+		}
+
+		ev.tracker = s.trackOutbox(ev.id)
+		if _, err = s.hPool.triggerByName(ctx, ev.hook, ev); err != nil {
+			s.outbox.forget(ev.id, ev.tracker)
+			blocked[ev.hook] = true
+			err = nil
+			continue
+		}
+		dispatched = append(dispatched, ev.tracker)
+
+		if _, err = tx.Exec(ctx, s.query(sqlDispatchOutbox), ev.id); err != nil {
+			return
+		}
+		n++
+	}
+
+	if commitErr := tx.Commit(ctx); commitErr != nil {
+		return n, commitErr
+	}
+	return
+}
+
+// outboxFlight - События outbox этого экземпляра сервиса, доставка которых еще не завершена
+type outboxFlight struct {
+	entries map[string]*deliveryTracker
+	sync.Mutex
+}
+
+func newOutboxFlight() *outboxFlight {
+	return &outboxFlight{entries: map[string]*deliveryTracker{}}
+}
+
+// forget - Удаление ожидания доставки события id. Возвращает false, если его уже удалили
+func (f *outboxFlight) forget(id string, t *deliveryTracker) bool {
+	f.Lock()
+	defer f.Unlock()
+	if f.entries[id] != t {
+		return false
+	}
+	delete(f.entries, id)
+	return true
+}
+
+// trackOutbox - Ожидание доставки события outbox. Когда доставка завершится у всех подписчиков (доставлено,
+// перенесено в dead letters или подписка удалена), строка удаляется из outbox
+func (s *Service) trackOutbox(id string) (t *deliveryTracker) {
+	t = newDeliveryTracker(func(bool) {
+		if !s.outbox.forget(id, t) {
+			return
+		}
+		if _, err := s.pg.Exec(context.Background(), s.query(sqlDeleteOutbox), id); err != nil {
+			log.Printf(serviceErr, s.name, fmt.Sprintf("cannot delete outbox event id='%s': %v", id, err))
+		}
+	})
+
+	s.outbox.Lock()
+	defer s.outbox.Unlock()
+	s.outbox.entries[id] = t
+	return
+}
+
+// resetOutbox - Возврат в outbox событий, доставка которых не завершилась до остановки сервиса,
+// чтобы их сразу отправил другой экземпляр или этот после перезапуска
+func (s *Service) resetOutbox(ctx context.Context) {
+	s.outbox.Lock()
+	ids := make([]string, 0, len(s.outbox.entries))
+	for id := range s.outbox.entries {
+		ids = append(ids, id)
+	}
+	s.outbox.entries = map[string]*deliveryTracker{}
+	s.outbox.Unlock()
+
+	if len(ids) == 0 || s.pg == nil {
+		return
+	}
+	if _, err := s.pg.Exec(ctx, s.query(sqlResetOutbox), ids); err != nil {
+		log.Printf(serviceErr, s.name, fmt.Sprintf("cannot return %d undelivered events to outbox: %v", len(ids), err))
+	}
+}
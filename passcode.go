@@ -0,0 +1,57 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// pass_code хранится в БД в виде соленого хеша: s1$<соль hex>$<sha256(соль + pass_code) hex>.
+// Сам pass_code - случайный UUID, поэтому быстрого хеша достаточно: перебор по хешу невозможен
+const passCodeHashPrefix = "s1$"
+
+const passCodeSaltSize = 16
+
+// newPassCode - Новый pass_code и его хеш для хранения в БД
+func newPassCode() (passCode, hash string, err error) {
+	passCode = uuid.New().String()
+	if hash, err = hashPassCode(passCode); err != nil {
+		return "", "", err
+	}
+	return
+}
+
+func hashPassCode(passCode string) (hash string, err error) {
+	salt := make([]byte, passCodeSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return "", err
+	}
+	return passCodeHashPrefix + hex.EncodeToString(salt) + "$" + passCodeDigest(salt, passCode), nil
+}
+
+func passCodeDigest(salt []byte, passCode string) string {
+	sum := sha256.Sum256(append(append([]byte{}, salt...), passCode...))
+	return hex.EncodeToString(sum[:])
+}
+
+// matchPassCode - Сравнение pass_code с хешем из БД за постоянное время
+func matchPassCode(stored, passCode string) bool {
+	rest, hashed := strings.CutPrefix(stored, passCodeHashPrefix)
+	if !hashed || passCode == "" {
+		return false
+	}
+
+	saltHex, digest, ok := strings.Cut(rest, "$")
+	if !ok {
+		return false
+	}
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil || len(salt) != passCodeSaltSize || len(digest) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(passCodeDigest(salt, passCode)), []byte(digest)) == 1
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPassCode(t *testing.T) {
+	passCode, hash, err := newPassCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, passCodeHashPrefix) || strings.Contains(hash, passCode) {
+		t.Fatalf("hash = %q", hash)
+	}
+	if !matchPassCode(hash, passCode) {
+		t.Errorf("matchPassCode(%q, %q) = false", hash, passCode)
+	}
+
+	// Соль случайная, поэтому одинаковые pass_code дают разные хеши
+	if again, _ := hashPassCode(passCode); again == hash {
+		t.Errorf("hashPassCode() returned the same hash twice")
+	}
+}
+
+func TestMatchPassCode(t *testing.T) {
+	const passCode = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+
+	// Хеш в том виде, в каком его пишет миграция 0019:
+	// 's1$' || md5(...) || '$' || encode(sha256(decode(salt, 'hex') || convert_to(pass_code, 'UTF8')), 'hex')
+	const migrated = "s1$5f4dcc3b5aa765d61d8327deb882cf99$c50808a63b31bd96f33a63c1bf0086603c3cb58cf49181804609e9764f965acc"
+
+	tests := []struct {
+		name     string
+		stored   string
+		passCode string
+		want     bool
+	}{
+		{name: "migration hash", stored: migrated, passCode: passCode, want: true},
+		{name: "wrong code", stored: migrated, passCode: "0c9e6679-7425-40de-944b-e07fc1f90ae7"},
+		{name: "empty code", stored: migrated, passCode: ""},
+		{name: "plain stored value", stored: passCode, passCode: passCode},
+		{name: "missing prefix", stored: strings.TrimPrefix(migrated, passCodeHashPrefix), passCode: passCode},
+		{name: "missing digest", stored: "s1$5f4dcc3b5aa765d61d8327deb882cf99", passCode: passCode},
+		{name: "bad salt hex", stored: "s1$5f4dcc3b5aa765d61d8327deb882cfzz$c50808a63b31bd96f33a63c1bf0086603c3cb58cf49181804609e9764f965acc", passCode: passCode},
+		{name: "short salt", stored: "s1$5f4dcc3b$c50808a63b31bd96f33a63c1bf0086603c3cb58cf49181804609e9764f965acc", passCode: passCode},
+		{name: "short digest", stored: "s1$5f4dcc3b5aa765d61d8327deb882cf99$c50808a63b31bd96f33a63c1bf008660", passCode: passCode},
+		{name: "uppercase digest", stored: "s1$5f4dcc3b5aa765d61d8327deb882cf99$" + strings.ToUpper(migrated[36:]), passCode: passCode},
+		{name: "empty", stored: "", passCode: passCode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchPassCode(tt.stored, tt.passCode); got != tt.want {
+				t.Errorf("matchPassCode(%q, %q) = %v, want %v", tt.stored, tt.passCode, got, tt.want)
+			}
+		})
+	}
+}
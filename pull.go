@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Схема URL pull подписки: pull://<id>. Адрес генерируется сервисом при подписке без url
+const pullScheme = "pull"
+
+// Ограничения запросов к pull подписке
+const (
+	defaultPullMax   = 10
+	maxPullMax       = 100
+	defaultPullWait  = 30 * time.Second
+	maxPullWait      = time.Minute
+	defaultPullLease = 30 * time.Second
+	maxPullLease     = time.Hour
+	maxPullAckIDs    = 1000
+)
+
+func isPullURL(url string) bool {
+	return strings.HasPrefix(url, pullScheme+"://")
+}
+
+func newPullURL() string {
+	return pullScheme + "://" + uuid.New().String()
+}
+
+// pullEvent - Событие, выданное клиенту pull подписки в аренду
+type pullEvent struct {
+	ID         int64     `json:"id"`         // ID события в inbox подписки, передается в ack/nack
+	Deliveries int       `json:"deliveries"` // Сколько раз событие выдавалось, больше 1 - повтор после nack или истечения аренды
+	Event      eventItem `json:"event"`
+}
+
+type pollResponse struct {
+	Success bool        `json:"success"`
+	Lease   string      `json:"lease,omitempty"` // Токен аренды для ack/nack
+	Events  []pullEvent `json:"events"`
+}
+
+type ackResponse struct {
+	Success bool `json:"success"`
+	Count   int  `json:"count"` // Сколько событий подтверждено или возвращено
+}
+
+// leaseInbox - Аренда не больше max неподтвержденных событий pull подписки на время lease.
+// Пока аренда не истекла, события не выдаются другим запросам
+func (s *Service) leaseInbox(ctx context.Context, subID int64, max int, lease time.Duration) (leaseID string, events []pullEvent, err error) {
+	leaseID = uuid.New().String()
+
+	var rows pgx.Rows
+	if rows, err = s.pg.Query(ctx, s.query(sqlLeaseInbox), subID, max, lease.Milliseconds(), leaseID); err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	events = []pullEvent{}
+	for rows.Next() {
+		var e pullEvent
+		var created time.Time
+		if err = rows.Scan(&e.ID, &e.Event.ID, &e.Event.Hook, &e.Event.Event, &e.Event.Payload, &created, &e.Deliveries); err != nil {
+			return "", nil, err
+		}
+		e.Event.Timestamp = created.Unix()
+		events = append(events, e)
+	}
+	return leaseID, events, rows.Err()
+}
+
+// settleLeased - Подтверждение (ack) или возврат (nack) арендованных событий. После nack событие снова
+// выдается через delay. Возвращает количество обработанных событий
+func (s *Service) settleLeased(ctx context.Context, subID int64, leaseID string, ids []int64, ack bool, delay time.Duration) (count int, err error) {
+	var tag pgconn.CommandTag
+	if ack {
+		tag, err = s.pg.Exec(ctx, s.query(sqlAckLeased), subID, ids, leaseID)
+	} else {
+		tag, err = s.pg.Exec(ctx, s.query(sqlNackLeased), subID, ids, leaseID, delay.Milliseconds())
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// durationParam - Параметр запроса в секундах
+func durationParam(r *web.Request, name string, def, max time.Duration) (d time.Duration, err error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+
+	var sec int64
+	if sec, err = strconv.ParseInt(v, 10, 64); err != nil || sec < 0 || sec > int64(max/time.Second) {
+		return 0, fmt.Errorf("incorrect parameter %s, expected seconds from 0 to %d", name, int64(max/time.Second))
+	}
+	return time.Duration(sec) * time.Second, nil
+}
+
+// pollHandler - Получение событий pull подписки с долгим опросом: если событий нет, запрос ждет их до wait секунд.
+// Выданные события арендуются на lease секунд и, если их не подтвердить, выдаются снова
+func (h *hookCtx) pollHandler(w web.ResponseWriter, r *web.Request) {
+	// pass_code только в заголовке: параметры запроса попадают в логи прокси
+	url, passCode := r.URL.Query().Get("url"), r.Header.Get(HeaderPassCode)
+
+	max := defaultPullMax
+	if v := r.URL.Query().Get("max"); v != "" {
+		var err error
+		if max, err = strconv.Atoi(v); err != nil || max < 1 || max > maxPullMax {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter max, expected from 1 to %d", maxPullMax))
+			return
+		}
+	}
+
+	wait, err := durationParam(r, "wait", defaultPullWait, maxPullWait)
+	if err != nil {
+		sendHookResponse(w, "", err)
+		return
+	}
+
+	lease, err := durationParam(r, "lease", defaultPullLease, maxPullLease)
+	if err != nil || lease == 0 {
+		sendHookResponse(w, "", fmt.Errorf("incorrect parameter lease, expected seconds from 1 to %d", int64(maxPullLease/time.Second)))
+		return
+	}
+
+	subID, ok := h.authorizeInbox(w, r, pullScheme, url, passCode)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	deadline := time.Now().Add(wait)
+
+	// Подключение к хабу, чтобы сразу узнать о новых событиях этого экземпляра сервиса
+	conn := h.s.streams.add(subID)
+	defer func() { h.s.streams.remove(subID, conn) }()
+
+	for {
+		leaseID, events, err := h.s.leaseInbox(ctx, subID, max, lease)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf(errorLog, fmt.Sprintf("pull: cannot lease inbox subscriber_id=%d: %v", subID, err))
+				sendHookResponse(w, "", newHTTPError(http.StatusInternalServerError, "cannot read events"))
+			}
+			return
+		}
+
+		remaining := time.Until(deadline)
+		if len(events) > 0 || remaining <= 0 {
+			if len(events) == 0 {
+				leaseID = ""
+			}
+			sendJSON(w, http.StatusOK, pollResponse{Success: true, Lease: leaseID, Events: events})
+			return
+		}
+
+		// События других экземпляров сервиса и истекшие аренды проверяются периодически
+		if remaining > streamPollInterval {
+			remaining = streamPollInterval
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-h.s.ctx.Done():
+			timer.Stop()
+			deadline = time.Now()
+		case <-conn.messages:
+		case <-conn.gone:
+			h.s.streams.remove(subID, conn)
+			conn = h.s.streams.add(subID)
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (h *hookCtx) ackHandler(w web.ResponseWriter, r *web.Request) {
+	h.settleHandler(w, r, true)
+}
+
+func (h *hookCtx) nackHandler(w web.ResponseWriter, r *web.Request) {
+	h.settleHandler(w, r, false)
+}
+
+// settleHandler - Подтверждение или возврат событий, полученных по токену аренды lease
+func (h *hookCtx) settleHandler(w web.ResponseWriter, r *web.Request, ack bool) {
+	var err error
+	if err = r.ParseMultipartForm(maxMultipartMemory); err != nil {
+		http.Error(w, fmt.Sprintf("error while parsing form-data: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// pass_code только в заголовке, как и у poll
+	url, passCode := r.PostFormValue("url"), r.Header.Get(HeaderPassCode)
+
+	leaseID := r.PostFormValue("lease")
+	if _, err = uuid.Parse(leaseID); err != nil {
+		sendHookResponse(w, "", fmt.Errorf("incorrect parameter lease"))
+		return
+	}
+
+	list := formList(r.PostForm["ids"])
+	if len(list) == 0 || len(list) > maxPullAckIDs {
+		sendHookResponse(w, "", fmt.Errorf("incorrect parameter ids, expected from 1 to %d ids", maxPullAckIDs))
+		return
+	}
+	ids := make([]int64, len(list))
+	for i := range list {
+		if ids[i], err = strconv.ParseInt(list[i], 10, 64); err != nil {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter ids"))
+			return
+		}
+	}
+
+	var delay time.Duration
+	if v := r.PostFormValue("delay"); v != "" && !ack {
+		var sec int64
+		if sec, err = strconv.ParseInt(v, 10, 64); err != nil || sec < 0 || sec > int64(maxPullLease/time.Second) {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter delay"))
+			return
+		}
+		delay = time.Duration(sec) * time.Second
+	}
+
+	subID, ok := h.authorizeInbox(w, r, pullScheme, url, passCode)
+	if !ok {
+		return
+	}
+
+	count, err := h.s.settleLeased(r.Context(), subID, leaseID, ids, ack, delay)
+	if err != nil {
+		log.Printf(errorLog, fmt.Sprintf("pull: cannot settle events subscriber_id=%d: %v", subID, err))
+		sendHookResponse(w, "", newHTTPError(http.StatusInternalServerError, "cannot settle events"))
+		return
+	}
+	sendJSON(w, http.StatusOK, ackResponse{Success: true, Count: count})
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ограничения ожидания по заголовку Retry-After и количества отказов 429 подряд
+const (
+	maxRetryAfter       = 10 * time.Minute
+	maxThrottledRetries = 10
+)
+
+// Имя внутреннего воркера, удаляющего неиспользуемые ограничители частоты
+const rateLimitsCleanupWorker = "hook_rate_limits_cleanup"
+
+// Через сколько после последней отправки ограничитель подписки удаляется. Новый создается с полным запасом
+// токенов, поэтому время должно быть больше, чем нужно на восполнение запаса
+const rateBucketIdle = 10 * time.Minute
+
+func validateRateLimit(limit float64, burst int) error {
+	if limit < 0 || burst < 0 || math.IsNaN(limit) || math.IsInf(limit, 0) {
+		return fmt.Errorf("incorrect parameter rate_limit or rate_burst")
+	}
+	return nil
+}
+
+// tokenBucket - Ограничитель частоты: не больше limit событий в секунду и не больше burst подряд
+type tokenBucket struct {
+	tokens       float64
+	last         time.Time
+	blockedUntil time.Time // Время, до которого подписчик попросил не присылать запросы (Retry-After)
+}
+
+func newTokenBucket(burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: float64(bucketBurst(burst)), last: now}
+}
+
+func bucketBurst(burst int) int {
+	if burst < 1 {
+		return 1
+	}
+	return burst
+}
+
+// take - Взятие одного токена. Возвращает, сколько нужно подождать, если токенов нет
+func (b *tokenBucket) take(now time.Time, limit float64, burst int) time.Duration {
+	b.tokens = math.Min(float64(bucketBurst(burst)), b.tokens+now.Sub(b.last).Seconds()*limit)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit * float64(time.Second))
+}
+
+// rateLimits - Ограничители частоты отправок подписчикам. Общие для всех хуков сервиса, ключ - ID подписки,
+// поэтому подписка по шаблону ограничивается суммарно по всем хукам
+type rateLimits struct {
+	buckets map[int64]*tokenBucket
+	sync.Mutex
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{buckets: map[int64]*tokenBucket{}}
+}
+
+func (r *rateLimits) bucket(sub *Subscriber, now time.Time) *tokenBucket {
+	b := r.buckets[sub.ID]
+	if b == nil {
+		b = newTokenBucket(sub.RateBurst, now)
+		r.buckets[sub.ID] = b
+	}
+	return b
+}
+
+// reserve - Резервирование отправки подписчику. Возвращает, сколько нужно подождать перед отправкой,
+// при ненулевом ожидании резерв не делается и его нужно запросить снова
+func (r *rateLimits) reserve(sub *Subscriber) time.Duration {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	b := r.bucket(sub, now)
+	if now.Before(b.blockedUntil) {
+		return b.blockedUntil.Sub(now)
+	}
+
+	if sub.RateLimit <= 0 {
+		b.last = now
+		return 0
+	}
+
+	return b.take(now, sub.RateLimit, sub.RateBurst)
+}
+
+// block - Запрет отправок подписчику на время d
+func (r *rateLimits) block(sub *Subscriber, d time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	b := r.bucket(sub, now)
+	if until := now.Add(d); until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+}
+
+// forget - Удаление ограничителя подписки, например после отписки
+func (r *rateLimits) forget(subID int64) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.buckets, subID)
+}
+
+// cleanup - Удаление ограничителей, которые не использовались дольше rateBucketIdle и не блокируют отправки
+func (r *rateLimits) cleanup() error {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	for id, b := range r.buckets {
+		if now.Sub(b.last) > rateBucketIdle && now.After(b.blockedUntil) {
+			delete(r.buckets, id)
+		}
+	}
+	return nil
+}
+
+// parseRetryAfter - Разбор заголовка Retry-After в виде секунд или HTTP даты. 0 - заголовок не задан или некорректен
+func parseRetryAfter(resp *http.Response) (d time.Duration) {
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if sec > int64(maxRetryAfter/time.Second) {
+			return maxRetryAfter
+		}
+		d = time.Duration(sec) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	}
+
+	switch {
+	case d < 0:
+		return 0
+	case d > maxRetryAfter:
+		return maxRetryAfter
+	}
+	return d
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{name: "not set", value: "", min: 0, max: 0},
+		{name: "seconds", value: "120", min: 2 * time.Minute, max: 2 * time.Minute},
+		{name: "seconds with spaces", value: " 5 ", min: 5 * time.Second, max: 5 * time.Second},
+		{name: "zero", value: "0", min: 0, max: 0},
+		{name: "too long", value: "86400", min: maxRetryAfter, max: maxRetryAfter},
+		{name: "overflow", value: "99999999999999999999", min: 0, max: 0},
+		{name: "negative", value: "-10", min: 0, max: 0},
+		{name: "fraction", value: "1.5", min: 0, max: 0},
+		{name: "garbage", value: "soon", min: 0, max: 0},
+		{name: "http date", value: now.Add(time.Minute).UTC().Format(http.TimeFormat), min: 58 * time.Second, max: time.Minute},
+		{name: "http date in the past", value: now.Add(-time.Hour).UTC().Format(http.TimeFormat), min: 0, max: 0},
+		{name: "http date too far", value: now.Add(24 * time.Hour).UTC().Format(http.TimeFormat), min: maxRetryAfter, max: maxRetryAfter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tt.value != "" {
+				resp.Header.Set("Retry-After", tt.value)
+			}
+			if got := parseRetryAfter(resp); got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %v, want from %v to %v", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name  string
+		limit float64
+		burst int
+		takes []time.Duration // Время взятия токена от start
+		waits []time.Duration // Ожидаемое ожидание для каждого взятия
+	}{
+		{
+			name:  "burst then wait",
+			limit: 2, burst: 3,
+			takes: []time.Duration{0, 0, 0, 0},
+			waits: []time.Duration{0, 0, 0, 500 * time.Millisecond},
+		},
+		{
+			name:  "refill",
+			limit: 2, burst: 1,
+			takes: []time.Duration{0, 0, 250 * time.Millisecond, 500 * time.Millisecond},
+			waits: []time.Duration{0, 500 * time.Millisecond, 250 * time.Millisecond, 0},
+		},
+		{
+			name:  "refill is capped by burst",
+			limit: 10, burst: 2,
+			takes: []time.Duration{0, 0, time.Hour, time.Hour, time.Hour},
+			waits: []time.Duration{0, 0, 0, 0, 100 * time.Millisecond},
+		},
+		{
+			name:  "zero burst means one",
+			limit: 1, burst: 0,
+			takes: []time.Duration{0, 0},
+			waits: []time.Duration{0, time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.burst, start)
+			for i, at := range tt.takes {
+				if got := b.take(start.Add(at), tt.limit, tt.burst); got != tt.waits[i] {
+					t.Errorf("take #%d at %v = %v, want %v", i+1, at, got, tt.waits[i])
+				}
+			}
+		})
+	}
+}
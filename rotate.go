@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/web"
+)
+
+// Переходный период ротации секретов подписки, в течение которого отправки подписываются и прежним секретом
+const (
+	defaultRotationGrace = 24 * time.Hour
+	maxRotationGrace     = 30 * 24 * time.Hour
+)
+
+type rotateResponse struct {
+	Success       bool   `json:"success"`
+	Code          string `json:"code"`                     // Новый pass_code
+	SigningSecret string `json:"signing_secret,omitempty"` // Новый секрет подписи, если отправки подписываются
+	GraceUntil    string `json:"grace_until"`              // До этого времени отправки подписываются и прежним секретом, RFC 3339
+}
+
+// rotate - Выпуск новых pass_code и секрета подписи (если отправки подписываются). Прежний pass_code сразу
+// перестает действовать, а прежним секретом отправки подписываются еще grace
+func (h *hookPool) rotate(ctx context.Context, name, url, passCode string, grace time.Duration) (code, signingSecret string, err error) {
+	if grace < 0 || grace > maxRotationGrace {
+		return "", "", fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter grace, expected up to %v", maxRotationGrace))
+	}
+
+	var id int64
+	if id, err = h.checkPassCode(ctx, name, url, passCode); err != nil {
+		return
+	}
+
+	var passCodeHash string
+	if code, passCodeHash, err = newPassCode(); err != nil {
+		return
+	}
+
+	// Новый секрет подписи сохраняется, только если у подписки уже есть секрет, поэтому без Config.SecretKey
+	// ротация pass_code тоже работает
+	var encrypted []byte
+	if len(h.parent.cfg.SecretKey) > 0 {
+		if signingSecret, err = NewSigningSecret(); err != nil {
+			return
+		}
+		if encrypted, err = h.parent.encryptSecret([]byte(signingSecret)); err != nil {
+			return
+		}
+	}
+
+	var signed bool
+	if err = h.parent.pg.QueryRow(ctx, h.parent.query(sqlRotateSubSecrets), id, passCodeHash, encrypted, grace.Milliseconds()).Scan(&signed); err != nil {
+		return "", "", err
+	}
+	if !signed {
+		signingSecret = ""
+	}
+	return
+}
+
+// rotateHandler - Ротация секретов подписки: url, pass_code, grace_seconds (по умолчанию сутки)
+func (h *hookCtx) rotateHandler(w web.ResponseWriter, r *web.Request) {
+	var err error
+	err = r.ParseMultipartForm(maxMultipartMemory)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error while parsing form-data: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	name := r.PathParams["name"]
+	url := r.PostFormValue("url")
+	passCode := r.PostFormValue("pass_code")
+
+	grace := defaultRotationGrace
+	if v := r.PostFormValue("grace_seconds"); v != "" {
+		var seconds int
+		if seconds, err = strconv.Atoi(v); err != nil || seconds < 0 {
+			sendHookResponse(w, "", fmt.Errorf("incorrect parameter grace_seconds"))
+			return
+		}
+		grace = time.Duration(seconds) * time.Second
+	}
+
+	keys, locked := h.passCodeLocked(w, r)
+	if locked {
+		return
+	}
+
+	var resp rotateResponse
+	resp.Code, resp.SigningSecret, err = h.s.RotateSubscriptionSecrets(r.Context(), name, url, passCode, grace)
+	h.s.inbound.passCodeChecked(keys, err)
+	if err != nil {
+		sendHookResponse(w, "", err)
+		return
+	}
+
+	resp.Success = true
+	resp.GraceUntil = time.Now().Add(grace).UTC().Format(time.RFC3339)
+	if sendJSON(w, http.StatusOK, resp) {
+		log.Printf("hook: subscription secrets rotated args:(hook='%s', url='%s', grace='%v')", name, redactURL(url), grace)
+	}
+}
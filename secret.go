@@ -0,0 +1,78 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// Секреты подписок (учетные данные для авторизации у получателя и т.п.) хранятся в БД
+// зашифрованными AES-GCM ключом Config.SecretKey. Формат: версия (1 байт) | nonce | шифротекст
+
+const secretVersion byte = 1
+
+var errNoSecretKey = fmt.Errorf("secret: Config.SecretKey is not configured")
+
+func validSecretKey(key []byte) bool {
+	switch len(key) {
+	case 0, 16, 24, 32:
+		return true
+	}
+	return false
+}
+
+func (s *Service) secretCipher() (aead cipher.AEAD, err error) {
+	if len(s.cfg.SecretKey) == 0 {
+		return nil, errNoSecretKey
+	}
+
+	var block cipher.Block
+	if block, err = aes.NewCipher(s.cfg.SecretKey); err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret - Шифрование секрета для хранения в БД. Пустой секрет остается пустым
+func (s *Service) encryptSecret(plain []byte) (data []byte, err error) {
+	if len(plain) == 0 {
+		return nil, nil
+	}
+
+	var aead cipher.AEAD
+	if aead, err = s.secretCipher(); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	data = append([]byte{secretVersion}, nonce...)
+	return aead.Seal(data, nonce, plain, nil), nil
+}
+
+// decryptSecret - Расшифровка секрета, прочитанного из БД
+func (s *Service) decryptSecret(data []byte) (plain []byte, err error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var aead cipher.AEAD
+	if aead, err = s.secretCipher(); err != nil {
+		return nil, err
+	}
+
+	if data[0] != secretVersion || len(data) < 1+aead.NonceSize() {
+		return nil, fmt.Errorf("secret: unsupported format")
+	}
+
+	nonce, ciphertext := data[1:1+aead.NonceSize()], data[1+aead.NonceSize():]
+	if plain, err = aead.Open(nil, nonce, ciphertext, nil); err != nil {
+		return nil, fmt.Errorf("secret: cannot decrypt, probably Config.SecretKey has been changed")
+	}
+	return
+}
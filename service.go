@@ -7,14 +7,19 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gocraft/web"
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// Максимальное количество коннектов в пуле, если не задано в Config.DBMaxConns
+const defaultDBMaxConns = 90
+
 const (
 	serviceErr  = "service: name='%s' error='%v'"
 	startingErr = "service: cannot start service '%s' error='%v'"
@@ -36,17 +41,37 @@ type Service struct {
 	wPool  *workerPool     // Фоновые воркеры
 	hPool  *hookPool       // Веб-хуки
 	pgURL  string          // Postgres URL
-	pgConf *pgx.ConnConfig // Информация о подлюченной БД
-	pg     *pgx.ConnPool   // Пул коннектов к БД
+	pgConf *pgxpool.Config // Информация о подлюченной БД
+	pg     *pgxpool.Pool   // Пул коннектов к БД
+	pgOwn  bool            // Пул создан сервисом (а не передан в Config.DBPool) и закрывается при остановке
+	cfg    Config          // Исходная конфигурация сервиса
+
+	ctx    context.Context // Контекст сервиса, отменяется при остановке
+	cancel context.CancelFunc
+
+	tokens *tokenCache // Кеш токенов OAuth2 для авторизации у подписчиков
+	limits *rateLimits // Ограничения частоты отправок подписчикам
+
+	inbound *inboundGuard // Защита эндпоинтов /hook, nil - если Config.Inbound не задан
+	streams *streamHub    // Клиенты, подключенные к потокам событий
+	sinks   *sinkPool     // Подключения к брокерам сообщений подписок
+	outbox  *outboxFlight // События outbox, доставка которых еще не завершена
+
+	dbSchema    string            // Схема БД, в которой лежат таблицы сервиса
+	dbPrefix    string            // Префикс имен таблиц сервиса
+	sqlReplacer *strings.Replacer // Подстановка схемы и префикса в запросы
 
 	hFuncMap           *HookFuncMap
-	deferredAddHook    map[string]string // Список отложенных добавлений хуков map[name]function_name
-	deferredDeleteHook map[string]bool   // Список отложенных удалений хуков map[name]function_name
+	deferredAddHook    map[string]deferredHook // Список отложенных добавлений хуков map[name]hook
+	deferredDeleteHook map[string]bool         // Список отложенных удалений хуков map[name]function_name
 	started            bool
 }
 
 func (s *Service) Name() string      { return s.name }
-func (s *Service) DB() *pgx.ConnPool { return s.pg }
+func (s *Service) DB() *pgxpool.Pool { return s.pg }
+
+// DBSchema - Схема БД, в которой сервис хранит веб-хуки
+func (s *Service) DBSchema() string { return s.dbSchema }
 
 // New - Конструктор нового сервиса
 func New(name string, serverCfg Config, pgURL string, funcMap *HookFuncMap) (s *Service, err error) {
@@ -59,6 +84,13 @@ func New(name string, serverCfg Config, pgURL string, funcMap *HookFuncMap) (s *
 		serverCfg.Mux = web.New(ApiContext{})
 	}
 
+	if serverCfg.DBSchema == "" {
+		serverCfg.DBSchema = defaultDBSchema
+		if serverCfg.DBSchemaPerService {
+			serverCfg.DBSchema = schemaFromName(name)
+		}
+	}
+
 	// Валидация аргументов функции
 	if err = checkArgs(name, serverCfg, pgURL); err != nil {
 		return nil, fmt.Errorf(serviceErr, "", err.Error())
@@ -76,21 +108,58 @@ func New(name string, serverCfg Config, pgURL string, funcMap *HookFuncMap) (s *
 			MaxHeaderBytes:    serverCfg.MaxHeaderBytes,
 		},
 		pgURL:              pgURL,
-		pgConf:             &pgx.ConnConfig{},
+		pg:                 serverCfg.DBPool,
+		cfg:                serverCfg,
+		dbSchema:           serverCfg.DBSchema,
+		dbPrefix:           serverCfg.DBTablePrefix,
+		sqlReplacer:        newSQLReplacer(serverCfg.DBSchema, serverCfg.DBTablePrefix),
+		tokens:             newTokenCache(),
+		limits:             newRateLimits(),
+		streams:            newStreamHub(),
+		sinks:              newSinkPool(),
+		outbox:             newOutboxFlight(),
 		hFuncMap:           funcMap,
-		deferredAddHook:    map[string]string{},
+		deferredAddHook:    map[string]deferredHook{},
 		deferredDeleteHook: map[string]bool{},
 	}
 
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
 	// Регистрация обработчиков подписки/отписки на веб-хуки
 	subMux := serverCfg.Mux.Subrouter(hookCtx{s: s}, "/hook")
+	if serverCfg.Inbound != nil {
+		s.inbound = newInboundGuard(serverCfg.Inbound)
+		subMux.Middleware(s.inbound.middleware)
+	}
 	subMux.Post("/sub/:name", (&hookCtx{s: s}).subscribeHandler)
 	subMux.Post("/unsub/:name", (&hookCtx{s: s}).unsubscribeHandler)
+	subMux.Post("/renew/:name", (&hookCtx{s: s}).renewHandler)
+	subMux.Post("/rotate/:name", (&hookCtx{s: s}).rotateHandler)
+	subMux.Get("/stream/:name", (&hookCtx{s: s}).streamHandler)
+	subMux.Get("/ws", (&hookCtx{s: s}).wsHandler)
+	subMux.Get("/poll/:name", (&hookCtx{s: s}).pollHandler)
+	subMux.Post("/ack/:name", (&hookCtx{s: s}).ackHandler)
+	subMux.Post("/nack/:name", (&hookCtx{s: s}).nackHandler)
+	if len(serverCfg.TriggerTokens) > 0 {
+		subMux.Post("/trigger/:name", (&hookCtx{s: s}).triggerHandler)
+	}
+	if len(serverCfg.AdminTokens) > 0 {
+		subMux.Get("/admin/subs", (&hookCtx{s: s}).listSubscribersHandler)
+	}
 	s.server.Handler = serverCfg.Mux
 
 	// Добавление пулов воркеров и веб-хуков
 	s.wPool = newWorkerPool(s)
 	s.hPool = newHookPool(s)
+
+	// Служебные воркеры
+	s.AddWorker(eventsCleanupWorker, time.Hour, s.cleanupEvents)
+	s.AddWorker(outboxWorker, time.Second, s.dispatchOutbox)
+	s.AddWorker(subscriptionReaperWorker, subscriptionReaperInterval, s.reapSubscriptions)
+	s.AddWorker(rateLimitsCleanupWorker, time.Minute, s.limits.cleanup)
+	if s.inbound != nil {
+		s.AddWorker(inboundCleanupWorker, time.Minute, s.inbound.cleanup)
+	}
 	return s, nil
 }
 
@@ -104,41 +173,28 @@ func (s *Service) Start(cert, key string) {
 	}()
 
 	// Подключение к БД
-	var pgConf pgx.ConnConfig
-	pgConf, err = pgx.ParseConnectionString(s.pgURL)
-	if err != nil {
+	if err = s.connectDB(s.ctx); err != nil {
 		return
 	}
 
-	s.pgConf = &pgConf
-	if s.pg, err = pgx.NewConnPool(pgx.ConnPoolConfig{MaxConnections: 90, ConnConfig: *s.pgConf}); err != nil {
+	// Применение недостающих миграций схемы
+	if err = s.migrate(s.ctx, nil); err != nil {
 		return
 	}
 
-	// Добавление недостающих таблиц
-	if err = s.configureDB(); err != nil {
+	// Шифрование заголовков подписок и URL брокеров, сохраненных открыто предыдущими версиями
+	if err = s.encryptPlainHeaders(s.ctx); err != nil {
+		return
+	}
+	if err = s.encryptPlainSinkURLs(s.ctx); err != nil {
 		return
 	}
 
 	// Загрузка данных о существующих хуках и функциях, которые выполняются при их вызове
-	if err = s.loadHooks(); err != nil {
+	if err = s.loadHooks(s.ctx); err != nil {
 		return
 	}
 
-	// Запуск сервера
-	go func() {
-		if cert != "" && key != "" {
-			err = s.server.ListenAndServeTLS(cert, key)
-		} else {
-			err = s.server.ListenAndServe()
-		}
-
-		if err != nil && err != http.ErrServerClosed {
-			err = fmt.Errorf(startingErr, s.name, err)
-			return
-		}
-	}()
-
 	s.started = true
 
 	// Удаление отложенных веб-хуков
@@ -156,20 +212,39 @@ func (s *Service) Start(cert, key string) {
 	wg2 := sync.WaitGroup{}
 	for k, v := range s.deferredAddHook {
 		wg2.Add(1)
-		go func(_wg *sync.WaitGroup, _name, _funcName string) {
+		go func(_wg *sync.WaitGroup, _name string, _hook deferredHook) {
 			defer _wg.Done()
-			s.AddHook(_name, _funcName)
+			s.AddHookWithOptions(_name, _hook.function, _hook.opts)
 		}(&wg2, k, v)
 	}
 	wg2.Wait()
 
+	// Сервер запускается после добавления отложенных хуков, чтобы события не отправлялись с настройками
+	// по умолчанию хуков, загруженных из БД (HookOptions в БД не хранятся)
+	go func() {
+		if cert != "" && key != "" {
+			err = s.server.ListenAndServeTLS(cert, key)
+		} else {
+			err = s.server.ListenAndServe()
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			err = fmt.Errorf(startingErr, s.name, err)
+			return
+		}
+	}()
+
 	// Запуск воркеров только после того, как все хуки добавлены
 	go s.wPool.startAll()
 
+	if s.cfg.NotifyChannel != "" {
+		go s.listenNotify()
+	}
+
 	log.Printf("service: Name='%s' has been started\n", s.name)
 
 	// Позаботимся о перехвате прерываний для корректной остановки сервиса
-	stop := make(chan os.Signal)
+	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGKILL, syscall.SIGSTOP, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGABRT)
 	for {
 		select {
@@ -180,8 +255,6 @@ func (s *Service) Start(cert, key string) {
 			os.Exit(1)
 		}
 	}
-
-	return
 }
 
 // Stop - Остановка сервиса
@@ -194,6 +267,16 @@ func (s *Service) Stop() (err error) {
 		return err
 	}
 
+	// Накопленные пачки отправляются до отмены контекста сервиса, пока доступны БД и брокеры
+	s.hPool.stopBatches(ctxShutDown)
+
+	s.cancel()
+	s.sinks.closeAll()
+	s.resetOutbox(ctxShutDown)
+	if s.pgOwn && s.pg != nil {
+		s.pg.Close()
+	}
+
 	log.Printf("service: Name='%s' has been stopped\n", s.name)
 	return
 }
@@ -206,22 +289,112 @@ type Config struct {
 	ReadTimeout       time.Duration
 	WriteTimeout      time.Duration
 	MaxHeaderBytes    int
+
+	// Схема БД для таблиц веб-хуков. По умолчанию web_hooks
+	DBSchema string
+	// Если DBSchema не задана, то использовать отдельную схему web_hooks_<name> для каждого сервиса
+	// (для сервиса "default" - web_hooks). Существующие данные из web_hooks при этом не переносятся
+	DBSchemaPerService bool
+	// Префикс имен таблиц, позволяет разместить несколько сервисов в одной схеме
+	DBTablePrefix string
+
+	// Готовый пул коннектов к БД. Если задан, то pgURL и настройки пула ниже не используются,
+	// а сам пул не закрывается при остановке сервиса
+	DBPool *pgxpool.Pool
+	// Максимальное количество коннектов в пуле. По умолчанию 90
+	DBMaxConns int32
+	// Минимальное количество поддерживаемых коннектов
+	DBMinConns int32
+	// Время жизни коннекта, после которого он будет закрыт
+	DBMaxConnLifetime time.Duration
+	// Время простоя коннекта, после которого он будет закрыт
+	DBMaxConnIdleTime time.Duration
+	// Период проверки состояния простаивающих коннектов
+	DBHealthCheckPeriod time.Duration
+
+	// Ключ AES (16, 24 или 32 байта) для шифрования секретов подписок в БД.
+	// Без него нельзя подписаться с авторизацией (SubscribeOptions.Auth), TLS (SubscribeOptions.TLS)
+	// и дополнительными заголовками (SubscribeOptions.Headers)
+	SecretKey []byte
+
+	// Настройки TLS исходящих запросов к подписчикам (клиентский сертификат, CA и т.п.)
+	DeliveryTLS *TLSConfig
+
+	// Сколько хранятся события и история их доставки. По умолчанию 7 дней
+	EventRetention time.Duration
+
+	// Ограничения частоты запросов к /hook, количества подписок и попыток подбора pass_code
+	Inbound *InboundLimits
+
+	// Разрешить подписки на брокеры сообщений (nats://, amqp://, kafka://) через /hook/sub.
+	// Через SubscribeHook они разрешены всегда
+	AllowSinkSubscriptions bool
+
+	// Разрешить подписки с авторизацией oauth2 через /hook/sub. Сервис сам ходит на token_url подписчика,
+	// поэтому без разрешения через него можно обратиться к внутренней сети. Через SubscribeHook они разрешены всегда
+	AllowOAuth2Subscriptions bool
+
+	// Канал Postgres, который сервис слушает (LISTEN) и вызывает хуки по сообщениям в нем
+	// (см. InstallTableTrigger). Пустой - не слушать
+	NotifyChannel string
+
+	// Токены, с которыми другие сервисы могут вызывать хуки через POST /hook/trigger/:name
+	// (заголовок "Authorization: Bearer <token>"). Если не заданы, то эндпоинт не регистрируется
+	TriggerTokens []string
+
+	// Токены доступа к административным эндпоинтам /hook/admin (заголовок "Authorization: Bearer <token>").
+	// Если не заданы, то эндпоинты не регистрируются
+	AdminTokens []string
 }
 
 type ApiContext struct {
 	Params map[string]interface{}
 }
 
-func (s *Service) configureDB() (err error) {
-	if _, err = s.pg.Exec(createHookSchema); err != nil {
+// connectDB - Подключение к БД. Повторный вызов, как и вызов с пулом из Config.DBPool, ничего не делает
+func (s *Service) connectDB(ctx context.Context) (err error) {
+	if s.pg != nil {
+		return
+	}
+
+	if s.pgConf, err = pgxpool.ParseConfig(s.pgURL); err != nil {
 		return
 	}
+
+	s.pgConf.MaxConns = defaultDBMaxConns
+	if s.cfg.DBMaxConns > 0 {
+		s.pgConf.MaxConns = s.cfg.DBMaxConns
+	}
+	if s.cfg.DBMinConns > 0 {
+		s.pgConf.MinConns = s.cfg.DBMinConns
+	}
+	if s.cfg.DBMaxConnLifetime > 0 {
+		s.pgConf.MaxConnLifetime = s.cfg.DBMaxConnLifetime
+	}
+	if s.cfg.DBMaxConnIdleTime > 0 {
+		s.pgConf.MaxConnIdleTime = s.cfg.DBMaxConnIdleTime
+	}
+	if s.cfg.DBHealthCheckPeriod > 0 {
+		s.pgConf.HealthCheckPeriod = s.cfg.DBHealthCheckPeriod
+	}
+
+	var pool *pgxpool.Pool
+	if pool, err = pgxpool.NewWithConfig(ctx, s.pgConf); err != nil {
+		return
+	}
+
+	if err = pool.Ping(ctx); err != nil {
+		pool.Close()
+		return
+	}
+
+	s.pg, s.pgOwn = pool, true
 	return
 }
 
-func (s *Service) loadHooks() (err error) {
-	var rows *pgx.Rows
-	if rows, err = s.pg.Query(sqlSelectHooks); err != nil {
+func (s *Service) loadHooks(ctx context.Context) (err error) {
+	var rows pgx.Rows
+	if rows, err = s.pg.Query(ctx, s.query(sqlSelectHooks)); err != nil {
 		return
 	}
 
@@ -239,13 +412,24 @@ func (s *Service) loadHooks() (err error) {
 			continue
 		}
 
-		s.hPool.addNoDB(newHook(tmp.Name, (*s.hFuncMap)[tmp.Function], s))
+		// Настройки хука, добавленного до Start, применяются сразу, а не только после отложенного добавления
+		var opts HookOptions
+		if deferred, ok := s.deferredAddHook[tmp.Name]; ok && deferred.opts.validate() == nil {
+			opts = deferred.opts
+		}
+		s.hPool.addNoDB(newHook(tmp.Name, (*s.hFuncMap)[tmp.Function], s, opts))
 	}
-	return
+	return rows.Err()
+}
+
+// deferredHook - Параметры отложенного добавления хука
+type deferredHook struct {
+	function string
+	opts     HookOptions
 }
 
-func (s *Service) deferAddHook(name, functionName string) {
-	s.deferredAddHook[name] = functionName
+func (s *Service) deferAddHook(name, functionName string, opts HookOptions) {
+	s.deferredAddHook[name] = deferredHook{function: functionName, opts: opts}
 }
 
 func (s *Service) deferDeleteHook(name string) {
@@ -261,9 +445,54 @@ func checkArgs(name string, serverCfg Config, pgURL string) (err error) {
 		return fmt.Errorf("invalid arg: 'serverCfg.Addr'")
 	}
 
-	if pgURL == "" {
+	if pgURL == "" && serverCfg.DBPool == nil {
 		return fmt.Errorf("invalid arg: 'pgURL'")
 	}
+
+	if serverCfg.DBMaxConns < 0 || serverCfg.DBMinConns < 0 ||
+		(serverCfg.DBMaxConns > 0 && serverCfg.DBMinConns > serverCfg.DBMaxConns) {
+		return fmt.Errorf("invalid arg: 'serverCfg.DBMinConns/DBMaxConns'")
+	}
+
+	if !validSchema(serverCfg.DBSchema) {
+		return fmt.Errorf("invalid arg: 'serverCfg.DBSchema'")
+	}
+
+	if !validTablePrefix(serverCfg.DBTablePrefix) {
+		return fmt.Errorf("invalid arg: 'serverCfg.DBTablePrefix'")
+	}
+
+	if !validSecretKey(serverCfg.SecretKey) {
+		return fmt.Errorf("invalid arg: 'serverCfg.SecretKey'")
+	}
+
+	if serverCfg.DeliveryTLS != nil {
+		if err = serverCfg.DeliveryTLS.validate(true); err != nil {
+			return fmt.Errorf("invalid arg: 'serverCfg.DeliveryTLS': %v", err)
+		}
+	}
+
+	if serverCfg.NotifyChannel != "" && !validName(serverCfg.NotifyChannel) {
+		return fmt.Errorf("invalid arg: 'serverCfg.NotifyChannel'")
+	}
+
+	for _, token := range serverCfg.TriggerTokens {
+		if token == "" {
+			return fmt.Errorf("invalid arg: 'serverCfg.TriggerTokens', empty token")
+		}
+	}
+
+	for _, token := range serverCfg.AdminTokens {
+		if token == "" {
+			return fmt.Errorf("invalid arg: 'serverCfg.AdminTokens', empty token")
+		}
+	}
+
+	if serverCfg.Inbound != nil {
+		if err = serverCfg.Inbound.validate(); err != nil {
+			return fmt.Errorf("invalid arg: 'serverCfg.Inbound': %v", err)
+		}
+	}
 	return
 }
 
@@ -287,11 +516,18 @@ func (s *Service) StopWorker(name string) { s.wPool.stopByName(name) }
 
 // AddHook - Добавление нового веб-хука
 func (s *Service) AddHook(name, functionName string) {
+	s.AddHookWithOptions(name, functionName, HookOptions{})
+}
+
+// AddHookWithOptions - Добавление нового веб-хука с дополнительными настройками.
+// Настройки не хранятся в БД: хук, загруженный из БД при старте, получает их только от AddHookWithOptions,
+// поэтому хуки с настройками нужно добавлять при каждом запуске до Start
+func (s *Service) AddHookWithOptions(name, functionName string, opts HookOptions) {
 	// Если сервис еще не стартовал, то добавление хука упадет с ошибкой из-за того,
 	// что функции для возова хуком еще нет. Поэтому отправляем добавление хука в отложенный вызов,
 	// чтобы выполнить ее после старта сервиса
 	if !s.started {
-		s.deferAddHook(name, functionName)
+		s.deferAddHook(name, functionName, opts)
 		return
 	}
 
@@ -300,7 +536,12 @@ func (s *Service) AddHook(name, functionName string) {
 		return
 	}
 
-	s.hPool.add(newHook(name, (*s.hFuncMap)[functionName], s))
+	if err := opts.validate(); err != nil {
+		log.Printf(hookErr, name, fmt.Sprintf("cannot create hook, invalid options: %v", err))
+		return
+	}
+
+	s.hPool.add(s.ctx, newHook(name, (*s.hFuncMap)[functionName], s, opts))
 }
 
 // DeleteHook - Удаление веб-хука. Все подписки удалятся вместе с ним
@@ -312,20 +553,75 @@ func (s *Service) DeleteHook(name string) {
 		return
 	}
 
-	s.hPool.delete(name)
+	s.hPool.delete(s.ctx, name)
+}
+
+// TriggerHook - Принудательное выполнение веб-хука. Возвращает ID события,
+// по которому подписчики могут дедуплицировать повторные отправки.
+// Если у хука нет подписчиков или ни одному из них событие не нужно (EventTypes, Filter), то событие
+// не сохраняется и возвращается пустой ID без ошибки.
+// Если функция хука (HookFuncMap.AddPerSubscriber) вернула ошибки для части подписчиков, то остальным событие
+// отправляется, а ошибки возвращаются вместе с ID события
+func (s *Service) TriggerHook(name string) (eventID string, err error) {
+	return s.hPool.triggerByName(s.ctx, name, nil)
+}
+
+// TriggerHookForm - Вызов веб-хука с готовыми данными события вместо вызова функции хука.
+// ID события возвращается так же, как в TriggerHook
+func (s *Service) TriggerHookForm(name string, form *Form) (eventID string, err error) {
+	if err = checkTriggerForm(name, form); err != nil {
+		return "", err
+	}
+	return s.hPool.triggerByName(s.ctx, name, newEvent(name, form))
+}
+
+func checkTriggerForm(name string, form *Form) (err error) {
+	if form == nil {
+		return fmt.Errorf(hookErr, name, "form is nil")
+	}
+	if form.Payload == nil {
+		form.Payload = map[string]string{}
+	}
+	if form.Event != "" && !validEventType(form.Event) {
+		return fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect event type='%s'", form.Event))
+	}
+	return
+}
+
+// SubscribeHook - Подписка на веб-хук. opts может быть nil, тогда подписчик получает все события хука
+func (s *Service) SubscribeHook(ctx context.Context, name, url string, opts *SubscribeOptions) (passCode string, err error) {
+	return s.hPool.subscribe(ctx, name, url, opts)
+}
+
+// SetSubscriberRateLimit - Изменение ограничения частоты отправок подписчику: не больше limit отправок в секунду
+// и не больше burst подряд. limit = 0 снимает ограничение
+func (s *Service) SetSubscriberRateLimit(ctx context.Context, name, url string, limit float64, burst int) (err error) {
+	return s.hPool.setRateLimit(ctx, name, url, limit, burst)
+}
+
+// SubscribeHookPull - Подписка без URL: события копятся в inbox подписки, клиент забирает их сам
+// через /hook/poll/:name. Возвращает сгенерированный адрес подписки, который нужен для получения событий и отписки
+func (s *Service) SubscribeHookPull(ctx context.Context, name string, opts *SubscribeOptions) (url, passCode string, err error) {
+	url = newPullURL()
+	if passCode, err = s.hPool.subscribe(ctx, name, url, opts); err != nil {
+		return "", "", err
+	}
+	return
 }
 
-// TriggerHook - Принудательное выполнение веб-хука
-func (s *Service) TriggerHook(name string) {
-	s.hPool.triggerByName(name)
+// RenewSubscription - Продление подписки со сроком (SubscribeOptions.Lease) на lease от текущего момента.
+// lease = 0 - на прежний срок. Возвращает новое время истечения подписки
+func (s *Service) RenewSubscription(ctx context.Context, name, url, passCode string, lease time.Duration) (expiresAt time.Time, err error) {
+	return s.hPool.renew(ctx, name, url, passCode, lease)
 }
 
-// SubscribeHook - Подписка на веб-хук
-func (s *Service) SubscribeHook(name, url string) (passCode string, err error) {
-	return s.hPool.subscribe(name, url)
+// RotateSubscriptionSecrets - Выпуск нового pass_code и, если отправки подписки подписываются, нового секрета подписи.
+// Прежний pass_code сразу перестает действовать, а отправки еще grace подписываются обоими секретами
+func (s *Service) RotateSubscriptionSecrets(ctx context.Context, name, url, passCode string, grace time.Duration) (newPassCode, signingSecret string, err error) {
+	return s.hPool.rotate(ctx, name, url, passCode, grace)
 }
 
 // UnsubscribeHook - Отписка от веб-хука
-func (s *Service) UnsubscribeHook(name, url, passCode string) (err error) {
-	return s.hPool.unsubscribe(name, url, passCode)
+func (s *Service) UnsubscribeHook(ctx context.Context, name, url, passCode string) (err error) {
+	return s.hPool.unsubscribe(ctx, name, url, passCode)
 }
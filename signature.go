@@ -0,0 +1,85 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeaderSignature - Подпись отправки: t=<unix секунды>,v1=<hex HMAC-SHA256(секрет, "<t>.<тело>")>.
+// Во время ротации секрета отправка подписывается обоими секретами, подписи v1 идут через запятую
+const HeaderSignature = "X-Hook-Signature"
+
+// Префикс секретов подписи, которые генерирует сервис
+const signingSecretPrefix = "whsec_"
+
+// Минимальная длина секрета подписи, переданного в SubscribeOptions.SigningSecret
+const minSigningSecretLen = 16
+
+// NewSigningSecret - Новый случайный секрет подписи отправок
+func NewSigningSecret() (secret string, err error) {
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err != nil {
+		return "", err
+	}
+	return signingSecretPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func validateSigningSecret(secret string) error {
+	if secret != "" && len(secret) < minSigningSecretLen {
+		return fmt.Errorf("signing secret is shorter than %d bytes", minSigningSecretLen)
+	}
+	return nil
+}
+
+// signingKeys - Секреты подписи отправок подписчику. previous действует до previousUntil после ротации
+type signingKeys struct {
+	current       []byte
+	previous      []byte
+	previousUntil time.Time
+}
+
+// sign - Установка заголовка подписи тела отправки
+func (k *signingKeys) sign(h http.Header, body []byte, now time.Time) {
+	if k == nil || len(k.current) == 0 {
+		return
+	}
+
+	t := strconv.FormatInt(now.Unix(), 10)
+	parts := []string{"t=" + t, "v1=" + signature(k.current, t, body)}
+	if len(k.previous) > 0 && now.Before(k.previousUntil) {
+		parts = append(parts, "v1="+signature(k.previous, t, body))
+	}
+	h.Set(HeaderSignature, strings.Join(parts, ","))
+}
+
+func signature(secret []byte, t string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// decryptSigning - Секреты подписи подписки, прочитанные из БД
+func (s *Service) decryptSigning(current, previous []byte, previousUntil time.Time) (keys *signingKeys, err error) {
+	if len(current) == 0 {
+		return nil, nil
+	}
+
+	keys = &signingKeys{previousUntil: previousUntil}
+	if keys.current, err = s.decryptSecret(current); err != nil {
+		return nil, err
+	}
+	if keys.previous, err = s.decryptSecret(previous); err != nil {
+		return nil, err
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSigningKeysSign(t *testing.T) {
+	current, previous := []byte("whsec_current-secret"), []byte("whsec_previous-secret")
+	body := []byte(`{"id":"1"}`)
+	now := time.Unix(1700000000, 0)
+
+	// Подпись, которую получатель считает своим секретом
+	expected := func(secret []byte) string {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("1700000000." + string(body)))
+		return "v1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		name string
+		keys *signingKeys
+		want string
+	}{
+		{name: "no keys", keys: nil, want: ""},
+		{name: "empty secret", keys: &signingKeys{}, want: ""},
+		{name: "single secret", keys: &signingKeys{current: current}, want: "t=1700000000," + expected(current)},
+		{
+			name: "grace period",
+			keys: &signingKeys{current: current, previous: previous, previousUntil: now.Add(time.Hour)},
+			want: "t=1700000000," + expected(current) + "," + expected(previous),
+		},
+		{
+			name: "grace period passed",
+			keys: &signingKeys{current: current, previous: previous, previousUntil: now},
+			want: "t=1700000000," + expected(current),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			tt.keys.sign(h, body, now)
+			if got := h.Get(HeaderSignature); got != tt.want {
+				t.Errorf("signature = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	u "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SinkMessage - Событие (или пачка событий) для отправки в брокер сообщений
+type SinkMessage struct {
+	Subject     string            // Имя хука. Используется как subject/routing key/topic, если они не заданы в URL подписки
+	Key         string            // Ключ партиционирования - имя хука, чтобы события хука сохраняли порядок
+	ID          string            // ID события или пачки для дедупликации на стороне получателя
+	Headers     map[string]string // Заголовки события (X-Hook-*) и подписки
+	ContentType string
+	Body        []byte // Событие в JSON, для пачки - JSON массив
+}
+
+// Sink - Получатель событий хука вместо HTTP подписчика, например брокер сообщений.
+// Ошибка Publish означает, что событие не принято, и оно будет отправлено повторно по тем же правилам, что и HTTP запрос
+type Sink interface {
+	Publish(ctx context.Context, msg *SinkMessage) error
+	Close() error
+}
+
+// SinkFactory - Подключение к получателю по URL подписки
+type SinkFactory func(url *u.URL) (Sink, error)
+
+var sinkFactories = map[string]SinkFactory{
+	"nats":  newNATSSink,
+	"amqp":  newAMQPSink,
+	"amqps": newAMQPSink,
+	"kafka": newKafkaSink,
+}
+
+var sinkFactoriesMu sync.RWMutex
+
+// RegisterSink - Регистрация своего получателя для схемы URL подписки. Вызывается до запуска сервиса
+func RegisterSink(scheme string, factory SinkFactory) {
+	sinkFactoriesMu.Lock()
+	defer sinkFactoriesMu.Unlock()
+	sinkFactories[strings.ToLower(scheme)] = factory
+}
+
+// sinkFactory - Получатель, зарегистрированный для схемы URL
+func sinkFactory(url string) (factory SinkFactory, ok bool) {
+	i := strings.Index(url, "://")
+	if i <= 0 {
+		return nil, false
+	}
+
+	sinkFactoriesMu.RLock()
+	defer sinkFactoriesMu.RUnlock()
+	factory, ok = sinkFactories[strings.ToLower(url[:i])]
+	return
+}
+
+func isSinkURL(url string) bool {
+	_, ok := sinkFactory(url)
+	return ok
+}
+
+// redactURL - URL без учетных данных для логов и ответов
+func redactURL(url string) string {
+	parsed, err := u.Parse(url)
+	if err != nil || parsed.User == nil {
+		return url
+	}
+	parsed.User = u.User("xxxxx")
+	return parsed.String()
+}
+
+// redactSinkError - Ошибка получателя без учетных данных из URL, который мог попасть в ее текст
+func redactSinkError(err error, url string) error {
+	parsed, parseErr := u.Parse(url)
+	if err == nil || parseErr != nil || parsed.User == nil {
+		return err
+	}
+
+	msg := strings.ReplaceAll(err.Error(), url, redactURL(url))
+	msg = strings.ReplaceAll(msg, parsed.User.String(), "xxxxx")
+	if password, ok := parsed.User.Password(); ok && password != "" {
+		msg = strings.ReplaceAll(msg, password, "xxxxx")
+	}
+	return errors.New(msg)
+}
+
+// sinkStoredURL - URL подписки на брокер для хранения в БД. Учетные данные заменяются отпечатком
+// "hmac-<hex>" (HMAC-SHA256 ключом Config.SecretKey), а полный URL возвращается зашифрованным.
+// Отпечаток не меняется, поэтому подписку по-прежнему можно найти по исходному URL
+func (s *Service) sinkStoredURL(url string) (stored string, secret []byte, err error) {
+	parsed, parseErr := u.Parse(url)
+	if parseErr != nil || parsed.User == nil || !isSinkURL(url) {
+		return url, nil, nil
+	}
+
+	if secret, err = s.encryptSecret([]byte(url)); err != nil {
+		return "", nil, err
+	}
+
+	mac := hmac.New(sha256.New, s.cfg.SecretKey)
+	mac.Write([]byte(parsed.User.String()))
+	parsed.User = u.User("hmac-" + hex.EncodeToString(mac.Sum(nil)[:16]))
+	return parsed.String(), secret, nil
+}
+
+// lookupURL - URL подписки в том виде, в котором он хранится в БД
+func (s *Service) lookupURL(url string) string {
+	if len(s.cfg.SecretKey) == 0 {
+		return url
+	}
+	if stored, _, err := s.sinkStoredURL(url); err == nil {
+		return stored
+	}
+	return url
+}
+
+// encryptPlainSinkURLs - Шифрование URL брокеров с учетными данными, сохраненных открыто до появления url_secret.
+// Без Config.SecretKey URL остаются как есть
+func (s *Service) encryptPlainSinkURLs(ctx context.Context) (err error) {
+	if len(s.cfg.SecretKey) == 0 {
+		return
+	}
+
+	var rows pgx.Rows
+	if rows, err = s.pg.Query(ctx, s.query(sqlSelectPlainSinkURLs)); err != nil {
+		return
+	}
+
+	type plainURL struct {
+		id     int64
+		stored string
+		secret []byte
+	}
+	var urls []plainURL
+	for rows.Next() {
+		var id int64
+		var url string
+		if err = rows.Scan(&id, &url); err != nil {
+			rows.Close()
+			return
+		}
+
+		p := plainURL{id: id}
+		if p.stored, p.secret, err = s.sinkStoredURL(url); err != nil {
+			rows.Close()
+			return
+		}
+		if p.secret != nil {
+			urls = append(urls, p)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, p := range urls {
+		if _, err = s.pg.Exec(ctx, s.query(sqlSetSinkURLSecret), p.id, p.stored, p.secret); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// sinkPool - Открытые подключения к получателям, ключ - полный URL подписки
+type sinkPool struct {
+	sinks   map[string]Sink
+	dialing map[string]*sinkDial // Подключения, которые открываются сейчас
+	closed  bool
+	sync.Mutex
+}
+
+// sinkDial - Открытие подключения к получателю. Остальные отправки по тому же URL ждут его результата
+type sinkDial struct {
+	done chan struct{}
+	sink Sink
+	err  error
+}
+
+func newSinkPool() *sinkPool {
+	return &sinkPool{sinks: map[string]Sink{}, dialing: map[string]*sinkDial{}}
+}
+
+// get - Подключение к получателю. Подключение открывается без блокировки пула, чтобы медленный брокер
+// не задерживал отправки другим получателям, и только одно на URL
+func (p *sinkPool) get(ctx context.Context, url string) (sink Sink, err error) {
+	p.Lock()
+	if sink = p.sinks[url]; sink != nil {
+		p.Unlock()
+		return
+	}
+	if p.closed {
+		p.Unlock()
+		return nil, fmt.Errorf("sink: service stopped")
+	}
+
+	d := p.dialing[url]
+	if d != nil {
+		p.Unlock()
+		select {
+		case <-d.done:
+			return d.sink, d.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	d = &sinkDial{done: make(chan struct{})}
+	p.dialing[url] = d
+	p.Unlock()
+
+	d.sink, d.err = dialSink(url)
+
+	p.Lock()
+	delete(p.dialing, url)
+	if d.err == nil {
+		if p.closed {
+			_ = d.sink.Close()
+			d.sink, d.err = nil, fmt.Errorf("sink: service stopped")
+		} else {
+			p.sinks[url] = d.sink
+		}
+	}
+	p.Unlock()
+	close(d.done)
+	return d.sink, d.err
+}
+
+func dialSink(url string) (Sink, error) {
+	factory, ok := sinkFactory(url)
+	if !ok {
+		return nil, fmt.Errorf("sink: unsupported url scheme")
+	}
+
+	parsed, err := u.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+	return factory(parsed)
+}
+
+// drop - Закрытие подключения после ошибки, при следующей отправке оно будет открыто заново
+func (p *sinkPool) drop(url string, sink Sink) {
+	p.Lock()
+	if p.sinks[url] == sink {
+		delete(p.sinks, url)
+	}
+	p.Unlock()
+
+	if err := sink.Close(); err != nil {
+		log.Printf(warningLog, fmt.Sprintf("sink: error while closing: %v", redactSinkError(err, url)))
+	}
+}
+
+func (p *sinkPool) closeAll() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.closed = true
+	for url, sink := range p.sinks {
+		if err := sink.Close(); err != nil {
+			log.Printf(warningLog, fmt.Sprintf("sink: error while closing: %v", redactSinkError(err, url)))
+		}
+		delete(p.sinks, url)
+	}
+}
+
+// sinkMessage - Сообщение для получателя с теми же заголовками, что и у HTTP запроса
+func (s *sendTask) sinkMessage() (msg *SinkMessage, err error) {
+	msg = &SinkMessage{
+		Subject:     s.sub.hook.name,
+		Key:         s.sub.hook.name,
+		ID:          s.events[0].id,
+		Headers:     map[string]string{},
+		ContentType: "application/json",
+	}
+	if s.batchID != "" {
+		msg.ID = s.batchID
+	}
+
+	h := http.Header{}
+	for k, v := range s.sub.Headers {
+		h.Set(k, v)
+	}
+	s.setHeaders(h)
+	for k := range h {
+		msg.Headers[k] = h.Get(k)
+	}
+
+	if s.batchID != "" {
+		items := make([]eventItem, len(s.events))
+		for i, e := range s.events {
+			items[i] = e.item()
+		}
+		msg.Body, err = json.Marshal(items)
+	} else {
+		msg.Body, err = json.Marshal(s.events[0].item())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.sub.signing != nil {
+		h = http.Header{}
+		s.sub.signing.sign(h, msg.Body, time.Now())
+		msg.Headers[HeaderSignature] = h.Get(HeaderSignature)
+	}
+	return
+}
+
+// sendSink - Попытка отправки получателю. Любая ошибка считается временной
+func (s *sendTask) sendSink(ctx context.Context) (outcome deliveryOutcome, err error) {
+	service := s.sub.hook.service
+
+	var msg *SinkMessage
+	if msg, err = s.sinkMessage(); err != nil {
+		s.lastErr = err.Error()
+		service.recordDelivery(ctx, s, 0, err, 0)
+		return deliveryFailed, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.sub.hook.opts.timeout())
+	defer cancel()
+
+	started := time.Now()
+	url := s.sub.dialURL()
+	var sink Sink
+	if sink, err = service.sinks.get(ctx, url); err == nil {
+		if err = sink.Publish(ctx, msg); err != nil {
+			service.sinks.drop(url, sink)
+		}
+	}
+	err = redactSinkError(err, url)
+	service.recordDelivery(ctx, s, 0, err, time.Since(started))
+
+	if err != nil {
+		s.lastErr = err.Error()
+		log.Printf(hookErr, s.sub.hook.name, fmt.Sprintf("cannot publish to sink url='%s': %v", s.sub.URL, err))
+		return deliveryRetryable, err
+	}
+	return deliveryDelivered, nil
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	u "net/url"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpSink - Публикация в AMQP 0-9-1 (RabbitMQ): amqp[s]://user:password@host:5672/vhost?exchange=x&routing_key=y.
+// Если routing_key не задан, то используется имя хука. Сообщение считается доставленным после подтверждения брокером
+type amqpSink struct {
+	conn       *amqp.Connection
+	ch         *amqp.Channel
+	exchange   string
+	routingKey string
+	sync.Mutex // Подтверждения канала приходят по порядку публикации
+}
+
+func newAMQPSink(url *u.URL) (Sink, error) {
+	server, exchange, routingKey := amqpTarget(url)
+	conn, err := amqp.Dial(server)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &amqpSink{conn: conn, ch: ch, exchange: exchange, routingKey: routingKey}, nil
+}
+
+// amqpTarget - Адрес брокера, exchange и routing key из URL подписки
+func amqpTarget(url *u.URL) (server, exchange, routingKey string) {
+	query := url.Query()
+	s := *url
+	s.RawQuery = ""
+	return s.String(), query.Get("exchange"), query.Get("routing_key")
+}
+
+func (a *amqpSink) Publish(ctx context.Context, msg *SinkMessage) error {
+	a.Lock()
+	defer a.Unlock()
+
+	key := a.routingKey
+	if key == "" {
+		key = msg.Subject
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+
+	confirm, err := a.ch.PublishWithDeferredConfirmWithContext(ctx, a.exchange, key, false, false, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  msg.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    msg.ID,
+		Timestamp:    time.Now(),
+		Body:         msg.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	ack, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !ack {
+		return fmt.Errorf("message rejected by broker")
+	}
+	return nil
+}
+
+func (a *amqpSink) Close() error {
+	return a.conn.Close()
+}
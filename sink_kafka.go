@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	u "net/url"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Сколько писатель Kafka ждет накопления пачки. Пачка всегда из одного сообщения, поэтому ожидание минимальное
+const kafkaBatchTimeout = 10 * time.Millisecond
+
+// kafkaSink - Публикация в Kafka: kafka://host:9092/<topic>?brokers=host2:9092,host3:9092.
+// Если topic не задан, то используется имя хука. Ключ сообщения - имя хука, так что события хука попадают
+// в одну партицию и сохраняют порядок
+type kafkaSink struct {
+	w *kafka.Writer
+}
+
+func newKafkaSink(url *u.URL) (Sink, error) {
+	if url.Host == "" {
+		return nil, fmt.Errorf("kafka: broker address is required")
+	}
+
+	brokers := []string{url.Host}
+	for _, b := range strings.Split(url.Query().Get("brokers"), ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+
+	return &kafkaSink{w: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        strings.TrimPrefix(url.Path, "/"),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		// Сообщения отправляются по одному и синхронно из общей очереди отправок. С BatchTimeout по умолчанию
+		// (1с) каждая публикация ждала бы секунду и задерживала доставку всех хуков
+		BatchSize:    1,
+		BatchTimeout: kafkaBatchTimeout,
+	}}, nil
+}
+
+func (k *kafkaSink) Publish(ctx context.Context, msg *SinkMessage) error {
+	m := kafka.Message{Key: []byte(msg.Key), Value: msg.Body}
+	if k.w.Topic == "" {
+		m.Topic = msg.Subject
+	}
+
+	m.Headers = append(m.Headers, kafka.Header{Key: "Content-Type", Value: []byte(msg.ContentType)})
+	for key, v := range msg.Headers {
+		m.Headers = append(m.Headers, kafka.Header{Key: key, Value: []byte(v)})
+	}
+	return k.w.WriteMessages(ctx, m)
+}
+
+func (k *kafkaSink) Close() error {
+	return k.w.Close()
+}
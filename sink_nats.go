@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	u "net/url"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsSink - Публикация в NATS: nats://[user:password@]host:4222/<subject>.
+// Если subject не задан, то используется имя хука
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSSink(url *u.URL) (Sink, error) {
+	server, subject := natsTarget(url)
+	conn, err := nats.Connect(server, nats.Name("web-hooks"))
+	if err != nil {
+		return nil, err
+	}
+	return &natsSink{conn: conn, subject: subject}, nil
+}
+
+// natsTarget - Адрес сервера NATS и subject из URL подписки
+func natsTarget(url *u.URL) (server, subject string) {
+	s := *url
+	s.Path, s.RawPath, s.RawQuery = "", "", ""
+	return s.String(), strings.TrimPrefix(url.Path, "/")
+}
+
+func (n *natsSink) Publish(ctx context.Context, msg *SinkMessage) error {
+	m := nats.NewMsg(n.subject)
+	if m.Subject == "" {
+		m.Subject = msg.Subject
+	}
+	m.Data = msg.Body
+	for k, v := range msg.Headers {
+		m.Header.Set(k, v)
+	}
+	m.Header.Set("Content-Type", msg.ContentType)
+	m.Header.Set(nats.MsgIdHdr, msg.ID)
+
+	if err := n.conn.PublishMsg(m); err != nil {
+		return err
+	}
+	// Ждем, пока сервер получит сообщение
+	return n.conn.FlushWithContext(ctx)
+}
+
+func (n *natsSink) Close() error {
+	n.conn.Close()
+	return nil
+}
@@ -1,21 +1,67 @@
 package service
 
+import "strings"
+
+// Все запросы пишутся с плейсхолдерами {schema} и {prefix}, которые подставляются для конкретного сервиса.
+// Это позволяет нескольким сервисам работать с одной БД, не пересекаясь по таблицам
+const (
+	schemaPlaceholder = "{schema}"
+	prefixPlaceholder = "{prefix}"
+
+	defaultDBSchema = "web_hooks"
+)
+
+// Коды ошибок Postgres
+const pgUniqueViolation = "23505"
+
+func newSQLReplacer(schema, prefix string) *strings.Replacer {
+	return strings.NewReplacer(schemaPlaceholder, schema, prefixPlaceholder, prefix)
+}
+
+// query - Подстановка схемы и префикса таблиц сервиса в запрос
+func (s *Service) query(q string) string {
+	return s.sqlReplacer.Replace(q)
+}
+
+// schemaFromName - Отдельная схема сервиса (Config.DBSchemaPerService). Для сервиса "default" - историческое имя web_hooks
+func schemaFromName(name string) string {
+	if name == "default" {
+		return defaultDBSchema
+	}
+
+	schema := defaultDBSchema + "_" + strings.ToLower(strings.ReplaceAll(name, "-", "_"))
+	if len(schema) > maxIdentLen {
+		schema = schema[:maxIdentLen]
+	}
+	return schema
+}
+
 // subscriptions query
 const (
-	sqlSubscribe            = `insert into web_hooks.subscribers (hook_name, url, pass_code) values ($1::name, $2::text, $3::uuid);`
-	sqlUnsubscribe          = `delete from web_hooks.subscribers where hook_name = $1::name and url = $2::text and pass_code = $3::uuid;`
-	sqlSelectSubCode        = `select pass_code from web_hooks.subscribers where hook_name = $1::name and url = $2::text`
-	sqlSelectSubs           = `select url, pass_code, err_count from web_hooks.subscribers where hook_name = $1::name;`
-	sqlResetSubErrCount     = `update web_hooks.subscribers set err_count = 0 where hook_name = $1::name and url = $2::text;`
-	sqlIncrementSubErrCount = `update web_hooks.subscribers set err_count = err_count+1 where hook_name = $1::name and url = $2::text;`
-	sqlDeleteSub            = `delete from web_hooks.subscribers where hook_name = $1::name and url = $2::text;`
+	sqlSubscribe            = `insert into {schema}.{prefix}subscribers (hook_name, url, pass_code, event_types, filter, headers, auth_type, auth_secret, tls_secret, rate_limit, rate_burst, host, description, contact_email, labels, metadata, lease_seconds, expires_at, signing_secret, headers_secret, url_secret) values ($1::name, $2::text, $3::text, $4::text[], $5::text, $6::jsonb, $7::text, $8::bytea, $9::bytea, $10::float8, $11::integer, $12::text, $13::text, $14::text, $15::text[], $16::jsonb, $17::integer, case when $17::integer > 0 then now() + $17::integer * interval '1 second' end, $18::bytea, $19::bytea, $20::bytea);`
+	sqlSubscribePattern     = `insert into {schema}.{prefix}subscribers (pattern, url, pass_code, event_types, filter, headers, auth_type, auth_secret, tls_secret, rate_limit, rate_burst, host, description, contact_email, labels, metadata, lease_seconds, expires_at, signing_secret, headers_secret, url_secret) values ($1::text, $2::text, $3::text, $4::text[], $5::text, $6::jsonb, $7::text, $8::bytea, $9::bytea, $10::float8, $11::integer, $12::text, $13::text, $14::text, $15::text[], $16::jsonb, $17::integer, case when $17::integer > 0 then now() + $17::integer * interval '1 second' end, $18::bytea, $19::bytea, $20::bytea);`
+	sqlUnsubscribe          = `delete from {schema}.{prefix}subscribers where id = $1::bigint returning auth_secret;`
+	sqlSelectSubCode        = `select id, pass_code from {schema}.{prefix}subscribers where (hook_name = $1::text::name or pattern = $1::text) and url = $2::text`
+	sqlSelectSubs           = `select id, url, pass_code, err_count, event_types, filter, coalesce(pattern, ''), headers, auth_secret, tls_secret, rate_limit, rate_burst, description, contact_email, labels, metadata, signing_secret, signing_secret_prev, coalesce(signing_secret_prev_until, to_timestamp(0)), headers_secret, url_secret from {schema}.{prefix}subscribers where (hook_name = $1::name or pattern_prefix = any($2::text[])) and (expires_at is null or expires_at > now());`
+	sqlSelectSubByID        = `select id, url, pass_code, err_count, event_types, filter, coalesce(pattern, ''), headers, auth_secret, tls_secret, rate_limit, rate_burst, description, contact_email, labels, metadata, signing_secret, signing_secret_prev, coalesce(signing_secret_prev_until, to_timestamp(0)), headers_secret, url_secret from {schema}.{prefix}subscribers where id = $1::bigint;`
+	sqlResetSubErrCount     = `update {schema}.{prefix}subscribers set err_count = 0 where id = $1::bigint;`
+	sqlIncrementSubErrCount = `update {schema}.{prefix}subscribers set err_count = err_count+1 where id = $1::bigint;`
+	sqlDeleteSub            = `delete from {schema}.{prefix}subscribers where id = $1::bigint;`
+	sqlCountHookSubs        = `select count(*) from {schema}.{prefix}subscribers where hook_name = $1::text::name or pattern = $1::text;`
+	sqlCountHostSubs        = `select count(*) from {schema}.{prefix}subscribers where host = $1::text;`
+	sqlListSubs             = `select id, coalesce(hook_name::text, pattern), url, err_count, event_types, filter, description, contact_email, labels, metadata, created_at, expires_at from {schema}.{prefix}subscribers where ($1::text = '' or hook_name = $1::text::name or pattern = $1::text) and labels @> $2::text[] order by id limit $3::integer offset $4::integer;`
+	sqlSelectPlainHeaders   = `select id, headers from {schema}.{prefix}subscribers where headers <> '{}'::jsonb and headers_secret is null;`
+	sqlSetHeadersSecret     = `update {schema}.{prefix}subscribers set headers = '{}'::jsonb, headers_secret = $2::bytea where id = $1::bigint;`
+	sqlSelectPlainSinkURLs  = `select id, url from {schema}.{prefix}subscribers where url_secret is null and url ~ '^[A-Za-z][A-Za-z0-9+.-]*://[^/]*@';`
+	sqlSetSinkURLSecret     = `update {schema}.{prefix}subscribers set url = $2::text, url_secret = $3::bytea where id = $1::bigint;`
+	sqlSetSubRateLimit      = `update {schema}.{prefix}subscribers set rate_limit = $3::float8, rate_burst = $4::integer where (hook_name = $1::text::name or pattern = $1::text) and url = $2::text;`
 )
 
 // hooks query
 const (
-	sqlSelectHooks = `select * from web_hooks.hooks;`
-	sqlAddHook     = `insert into web_hooks.hooks (name, function_name) values ($1::name, $2::name) on conflict (name) do nothing;`
-	sqlDeleteHook  = `delete from web_hooks.hooks where name = $1::name;`
+	sqlSelectHooks = `select * from {schema}.{prefix}hooks;`
+	sqlAddHook     = `insert into {schema}.{prefix}hooks (name, function_name) values ($1::name, $2::name) on conflict (name) do nothing;`
+	sqlDeleteHook  = `delete from {schema}.{prefix}hooks where name = $1::name;`
 )
 
 // Структура таблицы hooks в БД
@@ -24,27 +70,83 @@ type tHook struct {
 	Function string
 }
 
-const createHookSchema = `
-create schema if not exists web_hooks;
+// secret rotation query
+const (
+	sqlRotateSubSecrets = `update {schema}.{prefix}subscribers set pass_code_prev = null, pass_code_prev_until = null, pass_code = $2::text, signing_secret_prev = signing_secret, signing_secret_prev_until = case when signing_secret is not null then now() + $4::bigint * interval '1 millisecond' end, signing_secret = case when signing_secret is not null then $3::bytea end where id = $1::bigint returning signing_secret is not null;`
+)
 
-create table if not exists web_hooks.hooks
-(
-    Name Name not null
-        constraint hooks_pk
-            primary key,
-	function_name name
-);
+// subscription lease query
+const (
+	sqlRenewSub           = `update {schema}.{prefix}subscribers set lease_seconds = $2::integer, expires_at = now() + $2::integer * interval '1 second', expiry_warned = false where id = $1::bigint and (expires_at is null or expires_at > now()) returning expires_at;`
+	sqlSelectSubLease     = `select lease_seconds from {schema}.{prefix}subscribers where id = $1::bigint;`
+	sqlMarkExpiringSubs   = `update {schema}.{prefix}subscribers s set expiry_warned = true from (select id from {schema}.{prefix}subscribers where expires_at is not null and not expiry_warned and expires_at > now() and expires_at <= now() + greatest(least($1::bigint * interval '1 millisecond', lease_seconds * interval '1 second' / 10), $2::bigint * interval '1 millisecond') for update skip locked) e where s.id = e.id returning s.id, coalesce(s.hook_name::text, s.pattern), s.expires_at;`
+	sqlUnmarkExpiringSubs = `update {schema}.{prefix}subscribers set expiry_warned = false where id = any($1::bigint[]);`
+	sqlDeleteExpiredSubs  = `delete from {schema}.{prefix}subscribers where expires_at <= now() returning coalesce(hook_name::text, pattern), url, auth_secret;`
+)
 
-create table if not exists web_hooks.subscribers
+// events query
+const (
+	sqlInsertEvent     = `insert into {schema}.{prefix}events (id, hook_name, event_type, payload, created_at) values ($1::uuid, $2::name, $3::text, $4::jsonb, $5::timestamptz) on conflict (id) do nothing;`
+	sqlInsertDelivery  = `insert into {schema}.{prefix}deliveries (event_id, subscriber_id, url, attempt, status_code, error, duration_ms) values ($1::uuid, $2::bigint, $3::text, $4::integer, $5::integer, $6::text, $7::bigint);`
+	sqlDeleteOldEvents = `delete from {schema}.{prefix}events where created_at < $1::timestamptz;`
+)
+
+// inbox query
+const (
+	sqlInsertInbox        = `insert into {schema}.{prefix}inbox (subscriber_id, event_id, event_type, payload) values ($1::bigint, $2::uuid, $3::text, $4::jsonb) returning id;`
+	sqlSelectInbox        = `select i.id, e.id, e.hook_name, coalesce(i.event_type, e.event_type), coalesce(i.payload, e.payload), e.created_at from {schema}.{prefix}inbox i join {schema}.{prefix}events e on e.id = i.event_id where i.subscriber_id = $1::bigint and i.id > $2::bigint order by i.id limit $3::integer;`
+	sqlSelectInboxUnacked = `select i.id, e.id, e.hook_name, coalesce(i.event_type, e.event_type), coalesce(i.payload, e.payload), e.created_at from {schema}.{prefix}inbox i join {schema}.{prefix}events e on e.id = i.event_id where i.subscriber_id = $1::bigint and i.id > $2::bigint and i.acked_at is null order by i.id limit $3::integer;`
+	sqlAckInbox           = `update {schema}.{prefix}inbox set acked_at = now() where id = $1::bigint and subscriber_id = $2::bigint and acked_at is null;`
+	sqlLeaseInbox         = `with picked as (select id from {schema}.{prefix}inbox where subscriber_id = $1::bigint and acked_at is null and (leased_until is null or leased_until <= now()) order by id limit $2::integer for update skip locked), leased as (update {schema}.{prefix}inbox i set leased_until = now() + $3::bigint * interval '1 millisecond', lease_id = $4::uuid, deliveries = i.deliveries + 1 from picked where i.id = picked.id returning i.id, i.event_id, i.event_type, i.payload, i.deliveries) select l.id, e.id, e.hook_name, coalesce(l.event_type, e.event_type), coalesce(l.payload, e.payload), e.created_at, l.deliveries from leased l join {schema}.{prefix}events e on e.id = l.event_id order by l.id;`
+	sqlAckLeased          = `update {schema}.{prefix}inbox set acked_at = now(), leased_until = null, lease_id = null where subscriber_id = $1::bigint and id = any($2::bigint[]) and lease_id = $3::uuid and acked_at is null;`
+	sqlNackLeased         = `update {schema}.{prefix}inbox set leased_until = now() + $4::bigint * interval '1 millisecond', lease_id = null where subscriber_id = $1::bigint and id = any($2::bigint[]) and lease_id = $3::uuid and acked_at is null;`
+	sqlSelectInboxLastID  = `select coalesce(max(id), 0) from {schema}.{prefix}inbox where subscriber_id = $1::bigint;`
+)
+
+// outbox query
+const (
+	sqlInsertOutbox   = `insert into {schema}.{prefix}outbox (id, hook_name, event_type, payload, created_at) values ($1::uuid, $2::name, $3::text, $4::jsonb, $5::timestamptz);`
+	sqlSelectOutbox   = `select id, hook_name, event_type, payload, created_at from {schema}.{prefix}outbox where hook_name = any($2::name[]) and (dispatched_at is null or dispatched_at <= now() - $3::bigint * interval '1 millisecond') order by created_at limit $1::integer for update skip locked;`
+	sqlDispatchOutbox = `update {schema}.{prefix}outbox set dispatched_at = now() where id = $1::uuid;`
+	sqlResetOutbox    = `update {schema}.{prefix}outbox set dispatched_at = null where id = any($1::uuid[]);`
+	sqlDeleteOutbox   = `delete from {schema}.{prefix}outbox where id = $1::uuid;`
+)
+
+// ordered delivery query
+const (
+	sqlNextSubSeq       = `update {schema}.{prefix}subscribers set seq = seq+1 where id = $1::bigint returning seq;`
+	sqlInsertDeadLetter = `insert into {schema}.{prefix}dead_letters (event_id, subscriber_id, hook_name, url, seq, attempts, error) values ($1::uuid, $2::bigint, $3::name, $4::text, $5::bigint, $6::integer, $7::text);`
+)
+
+// migrations query
+const (
+	// Ключ advisory lock, под которым выполняются миграции
+	migrationLockKey = "{schema}.{prefix}schema_migrations"
+
+	sqlMigrationLock         = `select pg_advisory_lock(hashtext($1::text));`
+	sqlMigrationUnlock       = `select pg_advisory_unlock(hashtext($1::text));`
+	sqlMigrationsTableExists = `select to_regclass('{schema}.{prefix}schema_migrations') is not null;`
+	sqlSelectMigrations      = `select version from {schema}.{prefix}schema_migrations;`
+	sqlInsertMigration       = `insert into {schema}.{prefix}schema_migrations (version, name) values ($1::integer, $2::text);`
+)
+
+// notify query
+const (
+	// Ключ advisory lock, которым среди экземпляров сервиса выбирается единственный слушатель канала.
+	// К ключу добавляется имя канала
+	notifyLockKey = "{schema}.{prefix}notify:"
+
+	sqlNotifyTryLock = `select pg_try_advisory_lock(hashtext($1::text));`
+)
+
+const createMigrationsTable = `
+create schema if not exists {schema};
+
+create table if not exists {schema}.{prefix}schema_migrations
 (
-    hook_name Name
-        constraint subscribers_hooks_name_fk
-            references web_hooks.hooks
-            on update cascade on delete cascade,
-    url       text              not null,
-    pass_code uuid              not null,
-    err_count integer default 0 not null
-);
-
-create unique index if not exists subscribers_hook_name_url_uindex
-    on web_hooks.subscribers (hook_name, url);`
+    version    integer                   not null
+        constraint {prefix}schema_migrations_pk
+            primary key,
+    name       text                      not null,
+    applied_at timestamptz default now() not null
+);`
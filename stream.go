@@ -0,0 +1,311 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Схема URL подписки-потока: stream://<client-id>. События таких подписок не отправляются HTTP запросом,
+// а складываются в inbox подписчика, откуда клиент забирает их сам, например через /hook/stream/:name
+const streamScheme = "stream"
+
+// Заголовок с pass_code подписки для эндпоинтов, которые клиент вызывает сам
+const HeaderPassCode = "X-Hook-Pass-Code"
+
+// Настройки потоков SSE
+const (
+	streamBufferSize     = 64               // Событий в буфере соединения. При переполнении соединение закрывается
+	streamHeartbeat      = 15 * time.Second // Период комментария-пинга, чтобы прокси не закрывали соединение
+	streamPollInterval   = 5 * time.Second  // Период чтения inbox из БД, для событий других экземпляров сервиса
+	streamReplayPageSize = 100
+)
+
+var sseReplacer = strings.NewReplacer("\r", "", "\n", "")
+
+func isStreamURL(url string) bool {
+	return strings.HasPrefix(url, streamScheme+"://")
+}
+
+// isInboxURL - События подписки складываются в inbox, а не отправляются запросом
+func isInboxURL(url string) bool {
+	return isStreamURL(url) || isPullURL(url)
+}
+
+func (s *Subscriber) isInbox() bool {
+	return isInboxURL(s.URL)
+}
+
+// inboxMessage - Событие в inbox подписчика. ID растет в порядке добавления событий
+type inboxMessage struct {
+	id   int64
+	item eventItem
+}
+
+// pushInbox - Добавление события в inbox подписчика и отправка подключенным клиентам
+func (s *Service) pushInbox(ctx context.Context, sub *Subscriber, ev *event) (err error) {
+	m := inboxMessage{item: ev.item()}
+
+	// Свои данные подписчика хранятся в inbox, общие - только в events
+	var eventType, payload interface{}
+	if ev.personal {
+		eventType, payload = &m.item.Event, m.item.Payload
+	}
+
+	if err = s.pg.QueryRow(ctx, s.query(sqlInsertInbox), sub.ID, ev.id, eventType, payload).Scan(&m.id); err != nil {
+		return
+	}
+	s.streams.publish(sub.ID, m)
+	return
+}
+
+// loadInbox - События inbox подписчика с ID больше after. unacked - только неподтвержденные
+func (s *Service) loadInbox(ctx context.Context, subID, after int64, limit int, unacked bool) (messages []inboxMessage, err error) {
+	query := sqlSelectInbox
+	if unacked {
+		query = sqlSelectInboxUnacked
+	}
+
+	var rows pgx.Rows
+	if rows, err = s.pg.Query(ctx, s.query(query), subID, after, limit); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m inboxMessage
+		var created time.Time
+		if err = rows.Scan(&m.id, &m.item.ID, &m.item.Hook, &m.item.Event, &m.item.Payload, &created); err != nil {
+			return nil, err
+		}
+		m.item.Timestamp = created.Unix()
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// streamHub - Подключенные клиенты подписок-потоков этого экземпляра сервиса
+type streamHub struct {
+	conns map[int64]map[*streamConn]bool // Ключ - ID подписки
+	sync.Mutex
+}
+
+type streamConn struct {
+	messages chan inboxMessage
+	gone     chan struct{} // Закрывается, если клиент не успевает читать события
+}
+
+// ackInbox - Подтверждение получения события подписки. Возвращает false, если такого неподтвержденного события нет
+func (s *Service) ackInbox(ctx context.Context, subID, id int64) (ok bool, err error) {
+	var tag pgconn.CommandTag
+	if tag, err = s.pg.Exec(ctx, s.query(sqlAckInbox), id, subID); err != nil {
+		return
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{conns: map[int64]map[*streamConn]bool{}}
+}
+
+func (h *streamHub) add(subID int64) *streamConn {
+	h.Lock()
+	defer h.Unlock()
+
+	c := &streamConn{messages: make(chan inboxMessage, streamBufferSize), gone: make(chan struct{})}
+	if h.conns[subID] == nil {
+		h.conns[subID] = map[*streamConn]bool{}
+	}
+	h.conns[subID][c] = true
+	return c
+}
+
+func (h *streamHub) remove(subID int64, c *streamConn) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.conns[subID], c)
+	if len(h.conns[subID]) == 0 {
+		delete(h.conns, subID)
+	}
+}
+
+// publish - Отправка события подключенным клиентам подписки. Не блокируется: клиент, который не успевает читать,
+// отключается и продолжит с места остановки по Last-Event-ID
+func (h *streamHub) publish(subID int64, m inboxMessage) {
+	h.Lock()
+	defer h.Unlock()
+
+	for c := range h.conns[subID] {
+		select {
+		case c.messages <- m:
+		default:
+			close(c.gone)
+			delete(h.conns[subID], c)
+		}
+	}
+}
+
+// streamCredentials - url и pass_code подписки из запроса клиента. pass_code принимается только в заголовке
+// X-Hook-Pass-Code: параметры запроса попадают в логи прокси и историю браузера
+func streamCredentials(r *web.Request) (url, passCode string) {
+	return r.URL.Query().Get("url"), r.Header.Get(HeaderPassCode)
+}
+
+// authorizeInbox - Проверка pass_code подписки с inbox, адрес которой должен иметь схему scheme.
+// При ошибке отправляет ответ
+func (h *hookCtx) authorizeInbox(w web.ResponseWriter, r *web.Request, scheme, url, passCode string) (subID int64, ok bool) {
+	name := r.PathParams["name"]
+	if !strings.HasPrefix(url, scheme+"://") {
+		sendHookResponse(w, "", fmt.Errorf("incorrect parameter url, expected %s://<client-id>", scheme))
+		return 0, false
+	}
+
+	keys, locked := h.passCodeLocked(w, r)
+	if locked {
+		return 0, false
+	}
+
+	var err error
+	subID, err = h.s.hPool.checkPassCode(r.Context(), name, url, passCode)
+	h.s.inbound.passCodeChecked(keys, err)
+	if err != nil {
+		sendHookResponse(w, "", newHTTPError(http.StatusUnauthorized, err.Error()))
+		return 0, false
+	}
+	return subID, true
+}
+
+// streamHandler - Поток событий подписки в формате Server-Sent Events.
+// С заголовком Last-Event-ID клиент сначала получает пропущенные события из inbox
+func (h *hookCtx) streamHandler(w web.ResponseWriter, r *web.Request) {
+	url, passCode := streamCredentials(r)
+	subID, ok := h.authorizeInbox(w, r, streamScheme, url, passCode)
+	if !ok {
+		return
+	}
+
+	var lastID int64
+	var err error
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("last_event_id")
+	}
+	if resume != "" {
+		if lastID, err = strconv.ParseInt(resume, 10, 64); err != nil || lastID < 0 {
+			sendHookResponse(w, "", fmt.Errorf("incorrect Last-Event-ID"))
+			return
+		}
+	}
+
+	h.s.serveStream(w, r.Request, subID, lastID, resume != "")
+}
+
+func (s *Service) serveStream(w web.ResponseWriter, r *http.Request, subID, lastID int64, resume bool) {
+	ctx := r.Context()
+
+	// Клиент подключается к хабу до чтения inbox, чтобы не потерять события между чтением и подключением
+	conn := s.streams.add(subID)
+	defer s.streams.remove(subID, conn)
+
+	var err error
+	if !resume {
+		if err = s.pg.QueryRow(ctx, s.query(sqlSelectInboxLastID), subID).Scan(&lastID); err != nil {
+			log.Printf(errorLog, fmt.Sprintf("stream: cannot read inbox subscriber_id=%d: %v", subID, err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	if lastID, err = s.replayInbox(ctx, w, subID, lastID); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	poll := time.NewTicker(streamPollInterval)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case <-conn.gone:
+			return
+		case m := <-conn.messages:
+			if m.id <= lastID {
+				continue
+			}
+			if err = writeSSE(w, m); err != nil {
+				return
+			}
+			lastID = m.id
+		case <-poll.C:
+			if lastID, err = s.replayInbox(ctx, w, subID, lastID); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err = fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			w.Flush()
+		}
+	}
+}
+
+// replayInbox - Отправка клиенту событий inbox с ID больше after. Возвращает ID последнего отправленного
+func (s *Service) replayInbox(ctx context.Context, w web.ResponseWriter, subID, after int64) (last int64, err error) {
+	last = after
+	for {
+		var messages []inboxMessage
+		if messages, err = s.loadInbox(ctx, subID, last, streamReplayPageSize, false); err != nil {
+			if ctx.Err() == nil {
+				log.Printf(errorLog, fmt.Sprintf("stream: cannot read inbox subscriber_id=%d: %v", subID, err))
+			}
+			return
+		}
+
+		for _, m := range messages {
+			if err = writeSSE(w, m); err != nil {
+				return
+			}
+			last = m.id
+		}
+
+		if len(messages) < streamReplayPageSize {
+			return
+		}
+	}
+}
+
+// writeSSE - Запись события в поток: id - ID в inbox, event - тип события, data - событие в JSON
+func writeSSE(w web.ResponseWriter, m inboxMessage) (err error) {
+	var data []byte
+	if data, err = json.Marshal(m.item); err != nil {
+		return
+	}
+
+	if _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", m.id, sseReplacer.Replace(m.item.Event), data); err != nil {
+		return
+	}
+	w.Flush()
+	return
+}
@@ -1,15 +1,120 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 )
 
 type Subscriber struct {
 	*hook
-	URL      string
-	Pass     string
-	ErrCount int
+	ID         int64
+	Pattern    string // Шаблон имени хука (order.*), если подписка сделана не на конкретный хук
+	URL        string
+	Pass       string // Соленый хеш pass_code, сам pass_code сервис не хранит
+	ErrCount   int
+	EventTypes []string // Типы событий, которые получает подписчик. Пустой список - все события
+	Filter     string   // Выражение фильтра по полям Form.Payload (см. parseFilter)
+	Headers    map[string]string
+	Auth       *SubscriberAuth
+	TLS        *TLSConfig
+	RateLimit  float64 // Отправок в секунду, 0 - без ограничений
+	RateBurst  int
+
+	Description  string
+	ContactEmail string
+	Labels       []string
+	Metadata     map[string]interface{} // Произвольные данные подписчика
+
+	filter  filterExpr
+	signing *signingKeys
+	sinkURL string // Полный URL брокера с учетными данными, URL - без них
+}
+
+// dialURL - URL для подключения к получателю
+func (s *Subscriber) dialURL() string {
+	if s.sinkURL != "" {
+		return s.sinkURL
+	}
+	return s.URL
+}
+
+// SubscribeOptions - Дополнительные параметры подписки
+type SubscribeOptions struct {
+	EventTypes []string // Типы событий, на которые подписывается клиент. Пустой список - все события
+	Filter     string   // Фильтр по полям Form.Payload, например: status in (paid, refunded) and amount != 0
+
+	Headers map[string]string // Дополнительные заголовки каждой отправки
+	Auth    *SubscriberAuth   // Авторизация у получателя. Требует Config.SecretKey
+	TLS     *TLSConfig        // Клиентский сертификат, CA и т.п. только в виде PEM. Требует Config.SecretKey
+
+	RateLimit float64 // Не больше RateLimit отправок в секунду, 0 - без ограничений
+	RateBurst int     // Сколько отправок можно сделать подряд без пауз. По умолчанию 1
+
+	Description  string                 // Описание подписки для администраторов
+	ContactEmail string                 // Контакт владельца подписки
+	Labels       []string               // Метки для поиска подписок, например: prod, team-billing
+	Metadata     map[string]interface{} // Произвольный JSON объект, доступен функциям хука и фильтру (meta.<key>)
+
+	// Срок подписки (от минуты до года), после которого она удаляется, если ее не продлить через /hook/renew.
+	// 0 - бессрочная подписка
+	Lease time.Duration
+
+	// Секрет подписи отправок (заголовок X-Hook-Signature), см. NewSigningSecret. Требует Config.SecretKey.
+	// Пустой - отправки не подписываются
+	SigningSecret string
+}
+
+// accepts - Проверка, нужно ли отправлять подписчику событие с данными form
+func (s *Subscriber) accepts(form *Form) bool {
+	if !s.acceptsType(form.eventType(s.hook.name)) {
+		return false
+	}
+
+	if s.filter == nil {
+		return true
+	}
+	return s.filter.match(func(key string) string { return s.filterAttr(form, key) })
+}
+
+// acceptsType - Проверка, подписан ли подписчик на события типа event
+func (s *Subscriber) acceptsType(event string) bool {
+	if len(s.EventTypes) == 0 {
+		return true
+	}
+	for i := range s.EventTypes {
+		if s.EventTypes[i] == event {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAttr - Значение поля для фильтра: meta.<key> - метаданные подписки, label.<name> - "true", если у подписки
+// есть метка, остальные - поля Form.Payload
+func (s *Subscriber) filterAttr(form *Form, key string) string {
+	if k, ok := strings.CutPrefix(key, "meta."); ok {
+		return metaString(s.Metadata[k])
+	}
+	if l, ok := strings.CutPrefix(key, "label."); ok {
+		if s.HasLabel(l) {
+			return "true"
+		}
+		return ""
+	}
+	return form.Payload[key]
+}
+
+// HasLabel - Есть ли у подписки метка label
+func (s *Subscriber) HasLabel(label string) bool {
+	for i := range s.Labels {
+		if s.Labels[i] == label {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Subscriber) Subscribe() (passCode string, err error) {
@@ -22,19 +127,19 @@ func (s *Subscriber) Unsubscribe(passCode string) (err error) {
 	return
 }
 
-func (s *Subscriber) resetErrCount() {
+func (s *Subscriber) resetErrCount(ctx context.Context) {
 	if s.hook == nil {
 		log.Printf(hookErr, "", "invalid nil pointer reference")
 		return
 	}
 
-	_, err := s.hook.service.pg.Exec(sqlResetSubErrCount, s.hook.name, s.URL)
+	_, err := s.hook.service.pg.Exec(ctx, s.hook.service.query(sqlResetSubErrCount), s.ID)
 	if err != nil {
 		log.Printf(hookErr, s.hook.name, fmt.Sprintf("cannot reset err_count for url='%s'", s.URL))
 	}
 }
 
-func (s *Subscriber) incErrCount() {
+func (s *Subscriber) incErrCount(ctx context.Context) {
 	if s.hook == nil {
 		log.Printf(hookErr, "", "invalid nil pointer reference")
 		return
@@ -42,18 +147,32 @@ func (s *Subscriber) incErrCount() {
 
 	// Если предел ошибок превышен, то удаляем подписку
 	if s.ErrCount >= maxErrCount {
-		_, err := s.hook.service.pg.Exec(sqlDeleteSub, s.hook.name, s.URL)
-		if err != nil {
-			log.Printf(hookErr, s.hook.name, fmt.Sprintf("cannot delete subscription hook_name='%s', url='%s'", s.hook.name, s.URL))
-		}
-		log.Printf(hookWarning, s.hook.name, fmt.Sprintf("subscription hook_name='%s', url='%s' deleted cause error limit exceeded", s.hook.name, s.URL))
+		s.remove(ctx, "error limit exceeded")
 		return
 	}
 
-	_, err := s.hook.service.pg.Exec(sqlIncrementSubErrCount, s.hook.name, s.URL)
+	_, err := s.hook.service.pg.Exec(ctx, s.hook.service.query(sqlIncrementSubErrCount), s.ID)
 	if err != nil {
 		log.Printf(hookErr, s.hook.name, fmt.Sprintf("cannot increment err_count for subscription hook_name='%s', url='%s'", s.hook.name, s.URL))
 		return
 	}
+	s.ErrCount++
 	log.Printf(hookWarning, s.hook.name, fmt.Sprintf("subscription hook_name='%s', url='%s' err_count incremented", s.hook.name, s.URL))
 }
+
+// remove - Удаление подписки сервисом, например если подписчик перестал принимать события
+func (s *Subscriber) remove(ctx context.Context, reason string) {
+	if s.hook == nil {
+		log.Printf(hookErr, "", "invalid nil pointer reference")
+		return
+	}
+
+	_, err := s.hook.service.pg.Exec(ctx, s.hook.service.query(sqlDeleteSub), s.ID)
+	if err != nil {
+		log.Printf(hookErr, s.hook.name, fmt.Sprintf("cannot delete subscription hook_name='%s', url='%s'", s.hook.name, s.URL))
+		return
+	}
+	s.hook.service.limits.forget(s.ID)
+	s.hook.service.tokens.invalidate(s.Auth)
+	log.Printf(hookWarning, s.hook.name, fmt.Sprintf("subscription hook_name='%s', url='%s' deleted cause %s", s.hook.name, s.URL, reason))
+}
@@ -0,0 +1,295 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Как часто при установке соединения проверяются изменения файлов сертификатов
+const tlsReloadCheckInterval = 10 * time.Second
+
+// TLSConfig - Настройки TLS исходящих запросов к подписчикам.
+// Задается на уровне сервиса (Config.DeliveryTLS), хука (HookOptions.TLS) и подписки (SubscribeOptions.TLS),
+// более узкий уровень переопределяет заданные в нем поля. Сертификаты из файлов перечитываются при изменении
+type TLSConfig struct {
+	CertFile string   `json:"-"` // Клиентский сертификат для mTLS
+	KeyFile  string   `json:"-"` // Ключ клиентского сертификата
+	CAFiles  []string `json:"-"` // Корневые сертификаты, которым доверяет клиент. Если не заданы - системные
+
+	CertPEM string `json:"cert_pem,omitempty"` // То же, что CertFile, но в виде PEM
+	KeyPEM  string `json:"key_pem,omitempty"`  // То же, что KeyFile, но в виде PEM
+	CAPEM   string `json:"ca_pem,omitempty"`   // То же, что CAFiles, но в виде PEM
+
+	MinVersion uint16 `json:"min_version,omitempty"` // tls.VersionTLS12 по умолчанию
+	ServerName string `json:"server_name,omitempty"` // Имя сервера для SNI и проверки сертификата вместо хоста из URL
+}
+
+func (c *TLSConfig) hasCert() bool { return c.CertFile != "" || c.CertPEM != "" }
+func (c *TLSConfig) hasCA() bool   { return len(c.CAFiles) > 0 || c.CAPEM != "" }
+
+// validate - Проверка настроек. Для подписок, которые приходят извне, пути к файлам запрещены
+func (c *TLSConfig) validate(allowFiles bool) (err error) {
+	if !allowFiles && (c.CertFile != "" || c.KeyFile != "" || len(c.CAFiles) > 0) {
+		return fmt.Errorf("tls: certificate files are not allowed here, use PEM")
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") || (c.CertPEM == "") != (c.KeyPEM == "") {
+		return fmt.Errorf("tls: certificate and key must be set together")
+	}
+
+	if c.CertFile != "" && c.CertPEM != "" {
+		return fmt.Errorf("tls: certificate is set both as file and PEM")
+	}
+
+	if c.MinVersion != 0 && (c.MinVersion < tls.VersionTLS10 || c.MinVersion > tls.VersionTLS13) {
+		return fmt.Errorf("tls: unsupported min version %#x", c.MinVersion)
+	}
+
+	// Проверяем, что сертификаты вообще читаются
+	_, err = newTLSSource(c).load()
+	return
+}
+
+// parseTLSVersion - Разбор версии TLS в виде "1.2"
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("tls: unsupported version '%s'", v)
+}
+
+// Минимальная версия TLS, которую может задать подписчик
+const minSubscriberTLSVersion = tls.VersionTLS12
+
+// clampSubscriberTLS - Настройки TLS подписки с версией не ниже TLS 1.2: подписчик не может ослабить защиту
+// своих отправок. Исходные настройки не меняются
+func clampSubscriberTLS(c *TLSConfig) *TLSConfig {
+	if c == nil || c.MinVersion == 0 || c.MinVersion >= minSubscriberTLSVersion {
+		return c
+	}
+	clamped := *c
+	clamped.MinVersion = minSubscriberTLSVersion
+	return &clamped
+}
+
+// mergeTLS - Наложение настроек over на base. Сертификат с ключом и набор CA переопределяются целиком
+func mergeTLS(base, over *TLSConfig) *TLSConfig {
+	if over == nil {
+		return base
+	}
+	if base == nil {
+		return over
+	}
+
+	merged := *base
+	if over.hasCert() {
+		merged.CertFile, merged.KeyFile, merged.CertPEM, merged.KeyPEM = over.CertFile, over.KeyFile, over.CertPEM, over.KeyPEM
+	}
+	if over.hasCA() {
+		merged.CAFiles, merged.CAPEM = over.CAFiles, over.CAPEM
+	}
+	if over.MinVersion != 0 {
+		merged.MinVersion = over.MinVersion
+	}
+	if over.ServerName != "" {
+		merged.ServerName = over.ServerName
+	}
+	return &merged
+}
+
+// tlsKey - Ключ для кеширования клиентов с одинаковыми настройками TLS
+func tlsKey(c *TLSConfig) string {
+	if c == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%#v", *c)))
+	return hex.EncodeToString(sum[:])
+}
+
+// tlsSource - Источник сертификатов для tls.Config с перечитыванием файлов при их изменении
+type tlsSource struct {
+	cfg *TLSConfig
+
+	checked    time.Time            // Время последней проверки файлов
+	modTime    map[string]time.Time // Время изменения файлов при последней загрузке
+	generation int                  // Номер версии загруженных сертификатов, 0 - еще не загружались
+	cert       *tls.Certificate
+	roots      *x509.CertPool
+	sync.Mutex
+}
+
+type tlsMaterial struct {
+	cert  *tls.Certificate
+	roots *x509.CertPool
+}
+
+func newTLSSource(cfg *TLSConfig) *tlsSource {
+	return &tlsSource{cfg: cfg, modTime: map[string]time.Time{}}
+}
+
+func (t *tlsSource) files() (files []string) {
+	if t.cfg.CertFile != "" {
+		files = append(files, t.cfg.CertFile, t.cfg.KeyFile)
+	}
+	return append(files, t.cfg.CAFiles...)
+}
+
+// load - Чтение сертификатов из файлов и PEM
+func (t *tlsSource) load() (m tlsMaterial, err error) {
+	switch {
+	case t.cfg.CertFile != "":
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(t.cfg.CertFile, t.cfg.KeyFile); err != nil {
+			return m, fmt.Errorf("tls: cannot load client certificate: %v", err)
+		}
+		m.cert = &cert
+	case t.cfg.CertPEM != "":
+		var cert tls.Certificate
+		if cert, err = tls.X509KeyPair([]byte(t.cfg.CertPEM), []byte(t.cfg.KeyPEM)); err != nil {
+			return m, fmt.Errorf("tls: cannot parse client certificate: %v", err)
+		}
+		m.cert = &cert
+	}
+
+	if !t.cfg.hasCA() {
+		return
+	}
+
+	m.roots = x509.NewCertPool()
+	for _, file := range t.cfg.CAFiles {
+		var data []byte
+		if data, err = os.ReadFile(file); err != nil {
+			return m, fmt.Errorf("tls: cannot read CA file: %v", err)
+		}
+		if !m.roots.AppendCertsFromPEM(data) {
+			return m, fmt.Errorf("tls: no certificates found in CA file '%s'", file)
+		}
+	}
+	if t.cfg.CAPEM != "" && !m.roots.AppendCertsFromPEM([]byte(t.cfg.CAPEM)) {
+		return m, fmt.Errorf("tls: no certificates found in CA PEM")
+	}
+	return
+}
+
+// current - Актуальные сертификаты и номер их версии. Файлы проверяются не чаще tlsReloadCheckInterval,
+// при ошибке чтения продолжают использоваться ранее загруженные
+func (t *tlsSource) current() (*tls.Certificate, *x509.CertPool, int) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.generation > 0 && time.Since(t.checked) < tlsReloadCheckInterval {
+		return t.cert, t.roots, t.generation
+	}
+	t.checked = time.Now()
+
+	changed := t.generation == 0
+	modTime := map[string]time.Time{}
+	for _, file := range t.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Printf(warningLog, fmt.Sprintf("tls: cannot stat '%s': %v", file, err))
+			return t.cert, t.roots, t.generation
+		}
+		modTime[file] = info.ModTime()
+		if !info.ModTime().Equal(t.modTime[file]) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return t.cert, t.roots, t.generation
+	}
+
+	m, err := t.load()
+	if err != nil {
+		log.Printf(warningLog, err)
+		return t.cert, t.roots, t.generation
+	}
+
+	if t.generation > 0 {
+		log.Printf("tls: certificates reloaded\n")
+	}
+	t.cert, t.roots, t.modTime = m.cert, m.roots, modTime
+	t.generation++
+	return t.cert, t.roots, t.generation
+}
+
+// clientConfig - tls.Config для http.Transport с набором корневых сертификатов roots.
+// Клиентский сертификат запрашивается при каждом рукопожатии, поэтому всегда актуален
+func (t *tlsSource) clientConfig(roots *x509.CertPool) *tls.Config {
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: t.cfg.ServerName,
+		RootCAs:    roots,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert, _, _ := t.current(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+	}
+
+	if t.cfg.MinVersion != 0 {
+		c.MinVersion = t.cfg.MinVersion
+	}
+	return c
+}
+
+// tlsTransport - http.RoundTripper, который пересоздает транспорт при изменении корневых сертификатов,
+// т.к. tls.Config.RootCAs нельзя подменить у уже созданного транспорта
+type tlsTransport struct {
+	src        *tlsSource
+	base       *http.Transport // Шаблон транспорта без настроек TLS
+	generation int
+	current    *http.Transport
+	sync.Mutex
+}
+
+func newTLSTransport(cfg *TLSConfig, base *http.Transport) *tlsTransport {
+	return &tlsTransport{src: newTLSSource(cfg), base: base}
+}
+
+func (t *tlsTransport) transport() *http.Transport {
+	_, roots, generation := t.src.current()
+
+	t.Lock()
+	defer t.Unlock()
+	if t.current == nil || t.generation != generation {
+		if t.current != nil {
+			t.current.CloseIdleConnections()
+		}
+		t.current = t.base.Clone()
+		t.current.TLSClientConfig = t.src.clientConfig(roots)
+		t.generation = generation
+	}
+	return t.current
+}
+
+func (t *tlsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport().RoundTrip(req)
+}
+
+func (t *tlsTransport) CloseIdleConnections() {
+	t.Lock()
+	defer t.Unlock()
+	if t.current != nil {
+		t.current.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,85 @@
+package service
+
+import "strings"
+
+// Имена хуков - это топики из сегментов, разделенных точкой: order.created, order.payment.failed.
+// Подписаться можно как на конкретный хук, так и на шаблон, в котором сегмент заменен на
+//   - '*' - ровно один любой сегмент: order.* совпадает с order.created, но не с order.payment.failed
+//   - '#' - ноль или больше любых сегментов: order.# совпадает с order, order.created и order.payment.failed
+// Шаблоны сопоставляются с именем хука в момент его вызова, поэтому подписка распространяется и на хуки,
+// добавленные после нее
+
+const (
+	topicSeparator = "."
+	topicAnyOne    = "*"
+	topicAnyMany   = "#"
+)
+
+// isTopicPattern - Является ли имя шаблоном, а не именем конкретного хука
+func isTopicPattern(name string) bool {
+	return strings.Contains(name, topicAnyOne) || strings.Contains(name, topicAnyMany)
+}
+
+// matchTopic - Проверка совпадения имени хука topic с шаблоном pattern
+func matchTopic(pattern, topic string) bool {
+	return matchTopicSegments(strings.Split(pattern, topicSeparator), strings.Split(topic, topicSeparator))
+}
+
+// matchTopicSegments - Сопоставление динамическим программированием за O(len(pattern)*len(topic)):
+// next[j] - совпадает ли остаток шаблона после текущего сегмента с topic[j:], cur[j] - то же с текущим сегментом.
+// Перебор вариантов для '#' с возвратом занимал бы экспоненциальное время на шаблонах вида #.#.#...
+func matchTopicSegments(pattern, topic []string) bool {
+	next := make([]bool, len(topic)+1)
+	cur := make([]bool, len(topic)+1)
+	next[len(topic)] = true
+
+	for i := len(pattern) - 1; i >= 0; i-- {
+		// Несколько '#' подряд совпадают с тем же, что и один
+		if pattern[i] == topicAnyMany && i > 0 && pattern[i-1] == topicAnyMany {
+			continue
+		}
+
+		for j := len(topic); j >= 0; j-- {
+			switch {
+			case pattern[i] == topicAnyMany:
+				// Ноль сегментов или один сегмент и дальше снова '#'
+				cur[j] = next[j] || (j < len(topic) && cur[j+1])
+			case j == len(topic):
+				cur[j] = false
+			case pattern[i] == topicAnyOne || pattern[i] == topic[j]:
+				cur[j] = next[j+1]
+			default:
+				cur[j] = false
+			}
+		}
+		next, cur = cur, next
+	}
+	return next[0]
+}
+
+// topicPrefixes - Все начала имени хука по границам сегментов вместе с точкой: для order.created это
+// "", "order." и "order.created.". Шаблон может совпасть с хуком, только если его начало до первого '*' или '#'
+// (колонка pattern_prefix) - одно из них
+func topicPrefixes(topic string) []string {
+	segments := strings.Split(topic, topicSeparator)
+	prefixes := make([]string, 0, len(segments)+1)
+	prefix := ""
+	prefixes = append(prefixes, prefix)
+	for _, s := range segments {
+		prefix += s + topicSeparator
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// matchingHooks - Имена зарегистрированных хуков, подходящих под шаблон
+func (h *hookPool) matchingHooks(pattern string) (names []string) {
+	h.Lock()
+	defer h.Unlock()
+	for name := range h.hooks {
+		if matchTopic(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	return
+}
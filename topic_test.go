@@ -0,0 +1,132 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"order.created", "order.created", true},
+		{"order.created", "order.deleted", false},
+		{"order.created", "order", false},
+		{"order", "order.created", false},
+
+		{"*", "order", true},
+		{"*", "order.created", false},
+		{"order.*", "order.created", true},
+		{"order.*", "order", false},
+		{"order.*", "order.payment.failed", false},
+		{"*.created", "order.created", true},
+		{"*.created", "created", false},
+		{"*.*", "order", false},
+		{"*.*", "order.created", true},
+		{"order.*.failed", "order.payment.failed", true},
+		{"order.*.failed", "order.failed", false},
+
+		{"#", "order", true},
+		{"#", "order.payment.failed", true},
+		{"order.#", "order", true},
+		{"order.#", "order.created", true},
+		{"order.#", "order.payment.failed", true},
+		{"order.#", "orders.created", false},
+		{"#.failed", "failed", true},
+		{"#.failed", "order.payment.failed", true},
+		{"#.failed", "order.failed.retry", false},
+		{"order.#.failed", "order.failed", true},
+		{"order.#.failed", "order.a.b.failed", true},
+		{"order.#.failed", "order.a.b", false},
+		{"#.#", "order", true},
+		{"*.#", "order", true},
+		{"*.#", "order.created.x", true},
+		{"#.*", "order.created", true},
+		{"#.#.failed", "order.failed", true},
+		{"#.*.#", "order", true},
+		{"order.#.#", "order", true},
+		{"#.a.#.b", "x.a.y.b", true},
+		{"#.a.#.b", "x.a.y.b.c", false},
+
+		// * и # - только целые сегменты
+		{"order*", "orders", false},
+		{"ord#", "order", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchTopic(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("matchTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestIsTopicPattern(t *testing.T) {
+	tests := map[string]bool{
+		"order":         false,
+		"order.created": false,
+		"order.*":       true,
+		"#":             true,
+		"order.#.x":     true,
+	}
+
+	for name, want := range tests {
+		if got := isTopicPattern(name); got != want {
+			t.Errorf("isTopicPattern(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestTopicPrefixes(t *testing.T) {
+	got := topicPrefixes("order.payment.failed")
+	want := []string{"", "order.", "order.payment.", "order.payment.failed."}
+	if len(got) != len(want) {
+		t.Fatalf("topicPrefixes() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("topicPrefixes()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestMatchTopicPathological(t *testing.T) {
+	// Шаблон укладывается в лимит длины имени, а перебор с возвратом на нем работал бы минутами
+	pattern := strings.Repeat("#.", 31) + "z"
+	topic := strings.Repeat("a.", 40) + "b"
+
+	started := time.Now()
+	for i := 0; i < 100; i++ {
+		if matchTopic(pattern, topic) {
+			t.Fatalf("matchTopic(%q, %q) = true", pattern, topic)
+		}
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("100 matches took %v", elapsed)
+	}
+	if !matchTopic(pattern, topic+".z") {
+		t.Errorf("matchTopic(%q, %q) = false", pattern, topic+".z")
+	}
+}
+
+func TestValidTopicPattern(t *testing.T) {
+	tests := map[string]bool{
+		"order.*":                        true,
+		"order.#":                        true,
+		"#.order.#":                      true,
+		"#.*.#":                          true,
+		"#.#":                            false,
+		"order.#.#.x":                    false,
+		strings.Repeat("#.", 31) + "z":   false,
+		strings.Repeat("#.*.", 15) + "z": true,
+		"order.**":                       false,
+	}
+
+	for pattern, want := range tests {
+		if got := validTopicPattern(pattern); got != want {
+			t.Errorf("validTopicPattern(%q) = %v, want %v", pattern, got, want)
+		}
+	}
+}
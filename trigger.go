@@ -0,0 +1,125 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gocraft/web"
+)
+
+// triggerRequest - JSON тело запроса /hook/trigger/:name
+type triggerRequest struct {
+	Event   string                     `json:"event"`
+	Payload map[string]json.RawMessage `json:"payload"`
+}
+
+// triggerResponse - Ответ на вызов хука по HTTP
+type triggerResponse struct {
+	Success bool   `json:"success"`
+	EventID string `json:"event_id,omitempty"` // Пустой, если у хука нет подписчиков, которым нужно событие
+}
+
+// triggerHandler - Вызов хука другим сервисом. Доступен только с Config.TriggerTokens
+func (h *hookCtx) triggerHandler(w web.ResponseWriter, r *web.Request) {
+	if !authorizeBearer(r.Request, h.s.cfg.TriggerTokens) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="hook"`)
+		sendHookResponse(w, "", newHTTPError(http.StatusUnauthorized, "invalid trigger token"))
+		return
+	}
+
+	name := r.PathParams["name"]
+	if !validHookName(name) {
+		sendHookResponse(w, "", fmt.Errorf(hookErr, name, fmt.Sprintf("incorrect parameter name='%s'", name)))
+		return
+	}
+
+	if !h.s.hPool.exists(name) {
+		sendHookResponse(w, "", newHTTPError(http.StatusNotFound, fmt.Sprintf(hookErr, name, "this hook not exists")))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMultipartMemory)
+	form, err := triggerForm(r)
+	if err != nil {
+		sendHookResponse(w, "", err)
+		return
+	}
+
+	var eventID string
+	if eventID, err = h.s.TriggerHookForm(name, form); err != nil {
+		sendHookResponse(w, "", newHTTPError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	if sendJSON(w, http.StatusOK, triggerResponse{Success: true, EventID: eventID}) {
+		log.Printf("hook: triggered over http args:(hook='%s', event_id='%s')", name, eventID)
+	}
+}
+
+// triggerForm - Данные события из тела запроса. JSON: {"event": "...", "payload": {...}},
+// form-data и x-www-form-urlencoded: все поля - payload, тип события - параметр запроса event
+func triggerForm(r *web.Request) (form *Form, err error) {
+	event := r.URL.Query().Get("event")
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/json":
+		var req triggerRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, fmt.Errorf("incorrect JSON body: %v", err)
+		}
+		if req.Event != "" {
+			event = req.Event
+		}
+		form = formFromJSON(event, req.Payload)
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if err = r.ParseMultipartForm(maxMultipartMemory); err != nil {
+			return nil, fmt.Errorf("error while parsing form-data: %v", err)
+		}
+		form = postForm(r, event)
+	default:
+		if err = r.ParseForm(); err != nil {
+			return nil, fmt.Errorf("error while parsing form: %v", err)
+		}
+		form = postForm(r, event)
+	}
+
+	if event != "" && !validEventType(event) {
+		return nil, fmt.Errorf("incorrect parameter event='%s'", event)
+	}
+	return form, nil
+}
+
+func postForm(r *web.Request, event string) *Form {
+	form := NewForm()
+	form.SetEvent(event)
+	for k, v := range r.PostForm {
+		if len(v) > 0 {
+			form.Add(k, v[0])
+		}
+	}
+	return form
+}
+
+// authorizeBearer - Проверка токена "Authorization: Bearer <token>" по списку tokens.
+// Сравниваются хеши токенов за постоянное время, чтобы по времени ответа нельзя было подобрать токен
+func authorizeBearer(r *http.Request, tokens []string) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	match := 0
+	for _, t := range tokens {
+		expected := sha256.Sum256([]byte(t))
+		match |= subtle.ConstantTimeCompare(sum[:], expected[:])
+	}
+	return match == 1
+}
@@ -1,9 +1,59 @@
 package service
 
-import "regexp"
+import (
+	"regexp"
+	"strings"
+)
+
+// Максимальная длина идентификатора в Postgres
+const maxIdentLen = 63
 
 var rxName = regexp.MustCompile(`(?i)^([a-z])([a-z0-9_\-]){0,62}$`)
+var rxSchema = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// Имя хука - один или несколько сегментов через точку, шаблон дополнительно допускает сегменты * и #
+var rxHookName = regexp.MustCompile(`(?i)^[a-z][a-z0-9_\-]*(\.[a-z][a-z0-9_\-]*)*$`)
+var rxTopicPattern = regexp.MustCompile(`(?i)^([a-z][a-z0-9_\-]*|\*|#)(\.([a-z][a-z0-9_\-]*|\*|#))*$`)
+var rxEventType = regexp.MustCompile(`^[A-Za-z0-9_.:\-]{1,128}$`)
+var rxHeaderName = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]{1,256}$")
+var rxTablePrefix = regexp.MustCompile(`^([a-z_][a-z0-9_]{0,29})?$`)
+var rxClientID = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,128}$`)
+var rxLabel = regexp.MustCompile(`^[A-Za-z0-9_.:\-]{1,64}$`)
 
 func validName(name string) bool {
 	return rxName.MatchString(name)
 }
+
+func validHookName(name string) bool {
+	return len(name) <= maxIdentLen && rxHookName.MatchString(name)
+}
+
+func validTopicPattern(pattern string) bool {
+	// Несколько '#' подряд равнозначны одному, такие шаблоны не принимаются
+	return len(pattern) <= maxIdentLen && rxTopicPattern.MatchString(pattern) &&
+		!strings.Contains(topicSeparator+pattern+topicSeparator, topicSeparator+topicAnyMany+topicSeparator+topicAnyMany+topicSeparator)
+}
+
+func validEventType(event string) bool {
+	return rxEventType.MatchString(event)
+}
+
+func validHeaderName(name string) bool {
+	return rxHeaderName.MatchString(name)
+}
+
+func validSchema(schema string) bool {
+	return rxSchema.MatchString(schema)
+}
+
+func validTablePrefix(prefix string) bool {
+	return rxTablePrefix.MatchString(prefix)
+}
+
+func validClientID(id string) bool {
+	return rxClientID.MatchString(id)
+}
+
+func validLabel(label string) bool {
+	return rxLabel.MatchString(label)
+}
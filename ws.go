@@ -0,0 +1,316 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/gorilla/websocket"
+)
+
+// Настройки соединений WebSocket
+const (
+	wsMaxMessageBytes   = 64 << 10 // Максимальный размер сообщения клиента
+	wsMaxSubscriptions  = 100      // Подписок в одном соединении
+	wsWriteTimeout      = 10 * time.Second
+	wsPongTimeout       = 2 * streamHeartbeat
+	wsMaxPendingReplays = streamReplayPageSize
+)
+
+// Типы сообщений WebSocket
+const (
+	wsSubscribe   = "subscribe"   // Клиент: подключить подписку-поток (hook, url, pass_code)
+	wsUnsubscribe = "unsubscribe" // Клиент: перестать получать события подписки в этом соединении (hook, url)
+	wsAck         = "ack"         // Клиент: подтвердить получение события (hook, url, id)
+	wsSubscribed  = "subscribed"  // Сервер: подписка подключена
+	wsEvent       = "event"       // Сервер: событие подписки
+	wsError       = "error"       // Сервер: ошибка обработки сообщения клиента
+)
+
+var wsUpgrader = websocket.Upgrader{}
+
+// wsMessage - Сообщение WebSocket в обе стороны
+type wsMessage struct {
+	Type     string     `json:"type"`
+	Hook     string     `json:"hook,omitempty"`      // Имя хука или шаблон подписки
+	URL      string     `json:"url,omitempty"`       // stream://<client-id>
+	PassCode string     `json:"pass_code,omitempty"` // Только от клиента
+	ID       int64      `json:"id,omitempty"`        // ID события в inbox подписки, его же клиент передает в ack
+	Event    *eventItem `json:"event,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// wsSession - Соединение WebSocket с несколькими подписками-потоками
+type wsSession struct {
+	s   *Service
+	r   *http.Request
+	ws  *websocket.Conn
+	ctx context.Context
+
+	subs    map[string]*wsSub // Ключ - hook + url
+	writeMu sync.Mutex
+	sync.Mutex
+}
+
+// wsSub - Подписка-поток, подключенная к соединению
+type wsSub struct {
+	id     int64
+	hook   string
+	url    string
+	cancel context.CancelFunc
+}
+
+// wsHandler - Доставка событий подписок-потоков через WebSocket. Неподтвержденные (ack) события
+// отправляются заново при каждом подключении подписки
+func (h *hookCtx) wsHandler(w web.ResponseWriter, r *web.Request) {
+	ws, err := wsUpgrader.Upgrade(w, r.Request, nil)
+	if err != nil {
+		// Upgrader уже отправил ответ с ошибкой
+		return
+	}
+	defer ws.Close()
+
+	ctx, cancel := context.WithCancel(h.s.ctx)
+	defer cancel()
+
+	sess := &wsSession{s: h.s, r: r.Request, ws: ws, ctx: ctx, subs: map[string]*wsSub{}}
+	defer sess.closeAll()
+
+	ws.SetReadLimit(wsMaxMessageBytes)
+	_ = ws.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	go sess.ping()
+
+	for {
+		var m wsMessage
+		if err = ws.ReadJSON(&m); err != nil {
+			return
+		}
+		_ = ws.SetReadDeadline(time.Now().Add(wsPongTimeout))
+
+		switch m.Type {
+		case wsSubscribe:
+			err = sess.subscribe(m)
+		case wsUnsubscribe:
+			err = sess.unsubscribe(m)
+		case wsAck:
+			err = sess.ack(m)
+		default:
+			err = fmt.Errorf("unknown message type '%s'", m.Type)
+		}
+
+		if err != nil {
+			if err = sess.write(wsMessage{Type: wsError, Hook: m.Hook, URL: m.URL, ID: m.ID, Error: err.Error()}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// write - Отправка сообщения клиенту. Пишет в соединение только одна горутина за раз
+func (w *wsSession) write(m wsMessage) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	_ = w.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return w.ws.WriteJSON(m)
+}
+
+func (w *wsSession) ping() {
+	t := time.NewTicker(streamHeartbeat)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-t.C:
+			w.writeMu.Lock()
+			err := w.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			w.writeMu.Unlock()
+			if err != nil {
+				_ = w.ws.Close()
+				return
+			}
+		}
+	}
+}
+
+func (w *wsSession) subscribe(m wsMessage) (err error) {
+	if !isStreamURL(m.URL) {
+		return fmt.Errorf("incorrect parameter url, expected %s://<client-id>", streamScheme)
+	}
+
+	key := m.Hook + " " + m.URL
+	w.Lock()
+	_, exists := w.subs[key]
+	count := len(w.subs)
+	w.Unlock()
+	if exists {
+		return fmt.Errorf("subscription already connected")
+	}
+	if count >= wsMaxSubscriptions {
+		return fmt.Errorf("too many subscriptions in one connection")
+	}
+
+	keys, wait := w.s.inbound.passCodeLock(w.r)
+	if wait > 0 {
+		return fmt.Errorf("too many invalid pass_code attempts, retry after %d seconds", int(math.Ceil(wait.Seconds())))
+	}
+
+	var subID int64
+	subID, err = w.s.hPool.checkPassCode(w.ctx, m.Hook, m.URL, m.PassCode)
+	w.s.inbound.passCodeChecked(keys, err)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(w.ctx)
+	sub := &wsSub{id: subID, hook: m.Hook, url: m.URL, cancel: cancel}
+	w.Lock()
+	w.subs[key] = sub
+	w.Unlock()
+
+	// Подтверждение не отправлено - подписка не подключена и не должна занимать место до закрытия сессии
+	if err = w.write(wsMessage{Type: wsSubscribed, Hook: m.Hook, URL: m.URL}); err != nil {
+		cancel()
+		w.Lock()
+		if w.subs[key] == sub {
+			delete(w.subs, key)
+		}
+		w.Unlock()
+		return
+	}
+	go w.serve(ctx, sub)
+	return nil
+}
+
+func (w *wsSession) unsubscribe(m wsMessage) error {
+	key := m.Hook + " " + m.URL
+	w.Lock()
+	defer w.Unlock()
+
+	sub := w.subs[key]
+	if sub == nil {
+		return fmt.Errorf("subscription not connected")
+	}
+	sub.cancel()
+	delete(w.subs, key)
+	return nil
+}
+
+func (w *wsSession) ack(m wsMessage) error {
+	w.Lock()
+	sub := w.subs[m.Hook+" "+m.URL]
+	w.Unlock()
+	if sub == nil {
+		return fmt.Errorf("subscription not connected")
+	}
+
+	ok, err := w.s.ackInbox(w.ctx, sub.id, m.ID)
+	if err != nil {
+		log.Printf(errorLog, fmt.Sprintf("ws: cannot ack event subscriber_id=%d id=%d: %v", sub.id, m.ID, err))
+		return fmt.Errorf("cannot ack event")
+	}
+	if !ok {
+		return fmt.Errorf("unknown or already acked event")
+	}
+	return nil
+}
+
+func (w *wsSession) closeAll() {
+	w.Lock()
+	defer w.Unlock()
+
+	for key, sub := range w.subs {
+		sub.cancel()
+		delete(w.subs, key)
+	}
+}
+
+// serve - Отправка событий подписки: сначала все неподтвержденные из inbox, затем новые
+func (w *wsSession) serve(ctx context.Context, sub *wsSub) {
+	var lastID int64
+	var err error
+
+	for {
+		// Клиент подключается к хабу до чтения inbox, чтобы не потерять события между чтением и подключением
+		conn := w.s.streams.add(sub.id)
+		if lastID, err = w.replay(ctx, sub, lastID); err != nil {
+			w.s.streams.remove(sub.id, conn)
+			return
+		}
+
+		if !w.live(ctx, sub, conn, &lastID) {
+			w.s.streams.remove(sub.id, conn)
+			return
+		}
+		// Клиент не успевал читать и был отключен от хаба, пропущенное дочитывается из inbox
+		w.s.streams.remove(sub.id, conn)
+	}
+}
+
+// live - Отправка новых событий подписки. Возвращает true, если соединение было отключено от хаба
+func (w *wsSession) live(ctx context.Context, sub *wsSub, conn *streamConn, lastID *int64) bool {
+	poll := time.NewTicker(streamPollInterval)
+	defer poll.Stop()
+
+	var err error
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-conn.gone:
+			return true
+		case m := <-conn.messages:
+			if m.id <= *lastID {
+				continue
+			}
+			if err = w.send(sub, m); err != nil {
+				return false
+			}
+			*lastID = m.id
+		case <-poll.C:
+			if *lastID, err = w.replay(ctx, sub, *lastID); err != nil {
+				return false
+			}
+		}
+	}
+}
+
+// replay - Отправка неподтвержденных событий inbox с ID больше after
+func (w *wsSession) replay(ctx context.Context, sub *wsSub, after int64) (last int64, err error) {
+	last = after
+	for {
+		var messages []inboxMessage
+		if messages, err = w.s.loadInbox(ctx, sub.id, last, wsMaxPendingReplays, true); err != nil {
+			if ctx.Err() == nil {
+				log.Printf(errorLog, fmt.Sprintf("ws: cannot read inbox subscriber_id=%d: %v", sub.id, err))
+			}
+			return
+		}
+
+		for _, m := range messages {
+			if err = w.send(sub, m); err != nil {
+				return
+			}
+			last = m.id
+		}
+
+		if len(messages) < wsMaxPendingReplays {
+			return
+		}
+	}
+}
+
+func (w *wsSession) send(sub *wsSub, m inboxMessage) error {
+	item := m.item
+	return w.write(wsMessage{Type: wsEvent, Hook: sub.hook, URL: sub.url, ID: m.id, Event: &item})
+}